@@ -5,6 +5,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	_ "time/tzdata" // timezone database for minimal container images
 
 	"playstats/internal/config"
 	"playstats/internal/database"
@@ -19,17 +20,27 @@ func main() {
 	}
 
 	// Initialize database
-	db, err := database.New(cfg.DatabaseDSN)
+	db, err := database.New(cfg.DatabaseDialect, cfg.DatabaseDSN)
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 	defer db.Close()
+	db.SetQueryTimeout(cfg.DatabaseTimeout)
 
-	// Create repository
+	// Create repository, buffering stat writes unless disabled
 	repository := database.NewRepository(db)
+	var store database.Store = repository
+	if cfg.WriteBufferInterval > 0 {
+		buffered, err := database.NewBufferedStore(repository, cfg.WriteBufferInterval, cfg.WriteBufferSpillFile)
+		if err != nil {
+			log.Fatalf("Failed to create write buffer: %v", err)
+		}
+		defer buffered.Close()
+		store = buffered
+	}
 
 	// Initialize Discord bot
-	bot, err := discord.New(cfg.DiscordToken, repository)
+	bot, err := discord.New(cfg, store)
 	if err != nil {
 		log.Fatalf("Failed to create Discord bot: %v", err)
 	}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+	_ "time/tzdata" // timezone database for minimal container images
+
+	"playstats/internal/config"
+	"playstats/internal/database"
+	"playstats/pkg/utils"
+)
+
+const usage = `Usage: playstats <command>
+
+Commands:
+  rebuild             Recompute all totals, daily and weekly stats from the session log
+  migrate up          Apply all pending schema migrations
+  migrate down [n]    Revert the last n applied migrations (default 1)
+  migrate status      List migrations and whether they are applied`
+
+func main() {
+	commands := map[string]func(*config.Config, []string) error{
+		"rebuild": rebuild,
+		"migrate": migrate,
+	}
+	if len(os.Args) < 2 || commands[os.Args[1]] == nil {
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+
+	// Load configuration
+	cfg, err := config.LoadDatabase()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	if err := commands[os.Args[1]](cfg, os.Args[2:]); err != nil {
+		log.Fatalf("%s failed: %v", os.Args[1], err)
+	}
+}
+
+// rebuild recomputes the aggregate tables from the session log, using the
+// same timezones as the bot for daily and weekly stats
+func rebuild(cfg *config.Config, args []string) error {
+	// Increments left in the write buffer's spill file would be replayed on
+	// top of the rebuilt totals at the next start and counted twice
+	if _, err := os.Stat(cfg.WriteBufferSpillFile); err == nil {
+		return fmt.Errorf("write buffer spill file %s is pending; start the bot once to flush it, or delete it, before rebuilding", cfg.WriteBufferSpillFile)
+	}
+
+	db, err := database.New(cfg.DatabaseDialect, cfg.DatabaseDSN)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	db.SetQueryTimeout(cfg.DatabaseTimeout)
+
+	repository := database.NewRepository(db)
+
+	// Settings are loaded up front: the rebuild transaction may hold the
+	// only connection, so they can't be looked up while it runs
+	locations, err := newLocations(cfg.DefaultTimezone, repository)
+	if err != nil {
+		return err
+	}
+
+	started := time.Now()
+	result, err := repository.RebuildAggregates(locations.location)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("✅ Rebuilt aggregates from %d sessions in %s\n", result.Sessions, time.Since(started).Round(time.Millisecond))
+	fmt.Printf("   Voice: %s, idle: %s, activity: %s\n",
+		utils.FormatDuration(result.VoiceSeconds), utils.FormatDuration(result.IdleSeconds),
+		utils.FormatDuration(result.ActivitySeconds))
+	return nil
+}
+
+// migrate applies, reverts or lists schema migrations
+func migrate(cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing subcommand\n%s", usage)
+	}
+
+	db, err := database.Open(cfg.DatabaseDialect, cfg.DatabaseDSN)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "up":
+		if err := db.MigrateUp(); err != nil {
+			return err
+		}
+		fmt.Println("✅ Schema is up to date")
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of migrations %q", args[1])
+			}
+		}
+		return db.MigrateDown(steps)
+
+	case "status":
+		statuses, err := db.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if status.Applied {
+				applied = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-32s %s\n", status.Version, status.Name, applied)
+		}
+
+	default:
+		return fmt.Errorf("unknown subcommand %q\n%s", args[0], usage)
+	}
+	return nil
+}
+
+// locations resolves user and guild timezones from the stored settings
+type locations struct {
+	defaultTZ *time.Location
+	guilds    map[string]*time.Location
+	users     map[string]*time.Location
+}
+
+// newLocations loads every stored timezone into a resolver falling back to
+// defaultTZ
+func newLocations(defaultTZ *time.Location, repository *database.Repository) (*locations, error) {
+	guilds, users, err := repository.GetTimezones()
+	if err != nil {
+		return nil, err
+	}
+
+	l := &locations{
+		defaultTZ: defaultTZ,
+		guilds:    make(map[string]*time.Location),
+		users:     make(map[string]*time.Location),
+	}
+	for guildID, timezone := range guilds {
+		if loc := loadLocation(timezone); loc != nil {
+			l.guilds[guildID] = loc
+		}
+	}
+	for userID, timezone := range users {
+		if loc := loadLocation(timezone); loc != nil {
+			l.users[userID] = loc
+		}
+	}
+	return l, nil
+}
+
+// location gets the timezone for a user's stats in a guild: the user's own
+// timezone if set, otherwise the guild's, otherwise the default
+func (l *locations) location(guildID, userID string) *time.Location {
+	if loc, exists := l.users[userID]; exists {
+		return loc
+	}
+	if loc, exists := l.guilds[guildID]; exists {
+		return loc
+	}
+	return l.defaultTZ
+}
+
+// loadLocation loads an IANA timezone, returning nil if it is empty or unknown
+func loadLocation(name string) *time.Location {
+	if name == "" {
+		return nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		log.Printf("Error loading timezone %q: %v", name, err)
+		return nil
+	}
+	return loc
+}
@@ -2,36 +2,157 @@ package config
 
 import (
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
 // Config holds all configuration for our application
 type Config struct {
-	DiscordToken string
-	DatabaseDSN  string
+	DiscordToken         string
+	DatabaseDialect      string
+	DatabaseDSN          string
+	DatabaseTimeout      time.Duration
+	DefaultTimezone      *time.Location
+	CheckpointInterval   time.Duration
+	ShutdownTimeout      time.Duration
+	WriteBufferInterval  time.Duration
+	WriteBufferSpillFile string
+	TrackCustomStatus    bool
+	ActivityGracePeriod  time.Duration
+	ActivityMinDuration  time.Duration
 }
 
 // Load loads configuration from environment variables
 func Load() (*Config, error) {
+	config, err := LoadDatabase()
+	if err != nil {
+		return nil, err
+	}
+
+	config.DiscordToken = os.Getenv("DISCORD_TOKEN")
+	if config.DiscordToken == "" {
+		return nil, &ConfigError{Field: "DISCORD_TOKEN", Message: "DISCORD_TOKEN is required"}
+	}
+
+	return config, nil
+}
+
+// LoadDatabase loads the configuration needed by tools that only work on
+// the database, without requiring a Discord token
+func LoadDatabase() (*Config, error) {
 	// Load .env file if it exists
 	if err := godotenv.Load(); err != nil {
 		// .env file is optional, continue with environment variables
 	}
 
 	config := &Config{
-		DiscordToken: os.Getenv("DISCORD_TOKEN"),
-		DatabaseDSN:  os.Getenv("DATABASE_DSN"),
-	}
-
-	if config.DiscordToken == "" {
-		return nil, &ConfigError{Field: "DISCORD_TOKEN", Message: "DISCORD_TOKEN is required"}
+		DatabaseDSN: os.Getenv("DATABASE_DSN"),
 	}
 
 	if config.DatabaseDSN == "" {
 		return nil, &ConfigError{Field: "DATABASE_DSN", Message: "DATABASE_DSN is required"}
 	}
 
+	// sqlite://<path> selects SQLite, anything else is a PostgreSQL DSN
+	config.DatabaseDialect = "postgres"
+	if path, ok := strings.CutPrefix(config.DatabaseDSN, "sqlite://"); ok {
+		if path == "" {
+			return nil, &ConfigError{Field: "DATABASE_DSN", Message: "DATABASE_DSN must include a file path, e.g. sqlite://playstats.db"}
+		}
+		config.DatabaseDialect = "sqlite3"
+		config.DatabaseDSN = path
+	}
+
+	// How long a single database call may take (0 disables)
+	config.DatabaseTimeout = 5 * time.Second
+	if value := os.Getenv("DATABASE_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout < 0 {
+			return nil, &ConfigError{Field: "DATABASE_TIMEOUT", Message: "DATABASE_TIMEOUT must be a duration such as 5s"}
+		}
+		config.DatabaseTimeout = timeout
+	}
+
+	// Default timezone for guilds and users without their own setting
+	timezone := os.Getenv("DEFAULT_TIMEZONE")
+	if timezone == "" {
+		timezone = "Asia/Jakarta"
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, &ConfigError{Field: "DEFAULT_TIMEZONE", Message: "DEFAULT_TIMEZONE must be a valid IANA timezone"}
+	}
+	config.DefaultTimezone = loc
+
+	// How often open sessions are flushed to the totals (0 disables)
+	config.CheckpointInterval = 5 * time.Minute
+	if value := os.Getenv("CHECKPOINT_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval < 0 {
+			return nil, &ConfigError{Field: "CHECKPOINT_INTERVAL", Message: "CHECKPOINT_INTERVAL must be a duration such as 5m"}
+		}
+		config.CheckpointInterval = interval
+	}
+
+	// How long shutdown may spend flushing open sessions
+	config.ShutdownTimeout = 10 * time.Second
+	if value := os.Getenv("SHUTDOWN_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return nil, &ConfigError{Field: "SHUTDOWN_TIMEOUT", Message: "SHUTDOWN_TIMEOUT must be a positive duration such as 10s"}
+		}
+		config.ShutdownTimeout = timeout
+	}
+
+	// How often buffered stat increments are written (0 writes immediately)
+	config.WriteBufferInterval = 10 * time.Second
+	if value := os.Getenv("WRITE_BUFFER_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval < 0 {
+			return nil, &ConfigError{Field: "WRITE_BUFFER_INTERVAL", Message: "WRITE_BUFFER_INTERVAL must be a duration such as 10s"}
+		}
+		config.WriteBufferInterval = interval
+	}
+
+	// Where buffered increments are kept while the database is unreachable
+	config.WriteBufferSpillFile = os.Getenv("WRITE_BUFFER_SPILL_FILE")
+	if config.WriteBufferSpillFile == "" {
+		config.WriteBufferSpillFile = "playstats-spill.json"
+	}
+
+	// Whether custom statuses are recorded as activities
+	if value := os.Getenv("TRACK_CUSTOM_STATUS"); value != "" {
+		track, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, &ConfigError{Field: "TRACK_CUSTOM_STATUS", Message: "TRACK_CUSTOM_STATUS must be true or false"}
+		}
+		config.TrackCustomStatus = track
+	}
+
+	// How long an activity may disappear before its session is closed, so
+	// launcher restarts and flapping presences merge into one session
+	config.ActivityGracePeriod = time.Minute
+	if value := os.Getenv("ACTIVITY_GRACE_PERIOD"); value != "" {
+		grace, err := time.ParseDuration(value)
+		if err != nil || grace < 0 {
+			return nil, &ConfigError{Field: "ACTIVITY_GRACE_PERIOD", Message: "ACTIVITY_GRACE_PERIOD must be a duration such as 1m"}
+		}
+		config.ActivityGracePeriod = grace
+	}
+
+	// Activity sessions shorter than this are discarded (0 keeps all)
+	config.ActivityMinDuration = 30 * time.Second
+	if value := os.Getenv("ACTIVITY_MIN_DURATION"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration < 0 {
+			return nil, &ConfigError{Field: "ACTIVITY_MIN_DURATION", Message: "ACTIVITY_MIN_DURATION must be a duration such as 30s"}
+		}
+		config.ActivityMinDuration = duration
+	}
+
 	return config, nil
 }
 
@@ -0,0 +1,686 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// maxPendingIncrements is how many distinct rows may be pending before a
+// flush is started early
+const maxPendingIncrements = 1000
+
+// logIDRetention is how long the database ID of a queued session log insert
+// is kept after it was last used. Open sessions extend their row at every
+// checkpoint, so only rows of ended sessions go unused this long.
+const logIDRetention = 24 * time.Hour
+
+// Kinds of queued writes
+const (
+	writeAddSessionLog       = "add_session_log"
+	writeExtendSessionLog    = "extend_session_log"
+	writeSaveOpenSession     = "save_open_session"
+	writeDeleteOpenSession   = "delete_open_session"
+	writeTouchOpenSessions   = "touch_open_sessions"
+	writeAddListeningSession = "add_listening_session"
+)
+
+// pendingWrite is a session log, open session or listening history write
+// queued while the repository can't be reached. Session log inserts carry
+// a negative local ID that later extends refer to until it is written.
+type pendingWrite struct {
+	Op          string            `json:"op"`
+	SessionLog  *SessionLog       `json:"session_log,omitempty"`
+	OpenSession *OpenSession      `json:"open_session,omitempty"`
+	Listening   *ListeningSession `json:"listening,omitempty"`
+	LogID       int64             `json:"log_id,omitempty"`
+	RunID       string            `json:"run_id,omitempty"` // run whose sessions a touch updates
+	Time        time.Time         `json:"time"`             // new end of an extend, heartbeat of a touch
+}
+
+// errUnknownWrite is returned for a queued write of an unknown kind, such as
+// one spilled by a newer version
+var errUnknownWrite = errors.New("unknown buffered write")
+
+// resolvedLog is the database ID a queued session log insert was written
+// with, and when its local ID was last used
+type resolvedLog struct {
+	ID   int64
+	Used time.Time
+}
+
+// BufferedStore is a Store that coalesces stat increments in memory and
+// writes them to the repository in batched transactions. Failed batches
+// are kept and retried on the next flush, and spilled to a local file so
+// they survive a restart while the database is unreachable. Session log,
+// open session and listening history writes go straight to the repository
+// while it is reachable; when one fails it is queued in order with the
+// ones after it and replayed on the next flush. Writes failing for reasons
+// a retry can't fix, such as constraint violations, are logged and dropped
+// instead. Reads flush pending writes first; everything else goes straight
+// to the repository.
+type BufferedStore struct {
+	*Repository
+
+	interval  time.Duration
+	spillPath string
+
+	mu        sync.Mutex
+	pending   map[string]*Increment // key: table and row keys
+	order     []string              // pending keys in insertion order
+	writes    []pendingWrite        // queued writes in the order they were made
+	logIDs    map[int64]resolvedLog // key: local session log ID of a written insert
+	nextLogID int64                 // next local session log ID, counting down from -1
+	spilled   bool
+
+	flushMu sync.Mutex // serializes flushes
+	wake    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewBufferedStore wraps a repository with a write-behind buffer flushed
+// every interval. Increments left in spillPath by a previous run are
+// loaded and flushed first.
+func NewBufferedStore(repository *Repository, interval time.Duration, spillPath string) (*BufferedStore, error) {
+	b := &BufferedStore{
+		Repository: repository,
+		interval:   interval,
+		spillPath:  spillPath,
+		pending:    make(map[string]*Increment),
+		logIDs:     make(map[int64]resolvedLog),
+		nextLogID:  -1,
+		wake:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	if err := b.loadSpill(); err != nil {
+		return nil, err
+	}
+	if len(b.pending) > 0 || len(b.writes) > 0 {
+		if err := b.Flush(); err != nil {
+			log.Printf("Error flushing spilled writes, will retry: %v", err)
+		}
+	}
+
+	go b.run()
+	return b, nil
+}
+
+// Close stops the background flusher and flushes what is pending. If the
+// final flush fails the increments stay in the spill file.
+func (b *BufferedStore) Close() error {
+	close(b.stop)
+	<-b.done
+	return b.Flush()
+}
+
+// run flushes pending increments periodically and when the buffer fills up
+func (b *BufferedStore) run() {
+	defer close(b.done)
+
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+		case <-b.wake:
+		}
+		if err := b.Flush(); err != nil {
+			log.Printf("Error flushing buffered increments, will retry: %v", err)
+		}
+	}
+}
+
+// Flush replays queued writes in order and writes all pending increments in
+// one transaction. Either is tried even if the other fails, so a write the
+// database keeps rejecting doesn't hold back the increments. On failure
+// what is left is kept, merged with anything added meanwhile, and spilled
+// to disk.
+func (b *BufferedStore) Flush() error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	spilled := b.spilled
+	b.mu.Unlock()
+
+	err := errors.Join(b.replayWrites(), b.applyIncrements())
+	b.pruneLogIDs(time.Now())
+	if err != nil {
+		b.mu.Lock()
+		spillErr := b.writeSpillLocked()
+		b.mu.Unlock()
+		if spillErr != nil {
+			log.Printf("Error spilling buffered writes: %v", spillErr)
+		}
+		return err
+	}
+
+	if spilled {
+		b.mu.Lock()
+		// Writes added since the flush started were never spilled on
+		// their own, so the file can go once everything before is written
+		if err := os.Remove(b.spillPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Error removing spill file: %v", err)
+		}
+		b.spilled = false
+		b.mu.Unlock()
+	}
+	return nil
+}
+
+// applyIncrements writes all pending increments in one transaction, putting
+// them back if it fails
+func (b *BufferedStore) applyIncrements() error {
+	b.mu.Lock()
+	batch := make([]Increment, 0, len(b.order))
+	for _, key := range b.order {
+		batch = append(batch, *b.pending[key])
+	}
+	b.pending = make(map[string]*Increment)
+	b.order = nil
+	b.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	if err := b.Repository.ApplyIncrements(context.Background(), batch); err != nil {
+		b.mu.Lock()
+		for _, increment := range batch {
+			b.addLocked(increment)
+		}
+		b.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// replayWrites applies queued writes in order until the queue is empty or
+// one fails with a retryable error. Such a write stays queued until it
+// succeeds, so writes made during the replay queue up behind it instead of
+// overtaking it; other failures drop the write.
+func (b *BufferedStore) replayWrites() error {
+	for {
+		b.mu.Lock()
+		if len(b.writes) == 0 {
+			b.mu.Unlock()
+			return nil
+		}
+		write := b.writes[0]
+		if write.Op == writeExtendSessionLog && write.LogID < 0 {
+			resolved, exists := b.logIDs[write.LogID]
+			if !exists {
+				// The insert it extends was never queued or was
+				// dropped, so there is nothing to extend
+				b.writes = b.writes[1:]
+				b.mu.Unlock()
+				continue
+			}
+			write.LogID = resolved.ID
+		}
+		b.mu.Unlock()
+
+		id, err := b.apply(context.Background(), write)
+		if err != nil && isRetryable(err) {
+			return err
+		}
+		if err != nil {
+			log.Printf("Error replaying %s, dropped: %v", write.Op, err)
+		}
+
+		b.mu.Lock()
+		if write.Op == writeAddSessionLog && err == nil {
+			b.logIDs[write.SessionLog.ID] = resolvedLog{ID: id, Used: time.Now()}
+		}
+		b.writes = b.writes[1:]
+		b.mu.Unlock()
+	}
+}
+
+// pruneLogIDs forgets the database IDs of session log inserts whose local
+// IDs have not been used for logIDRetention
+func (b *BufferedStore) pruneLogIDs(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, resolved := range b.logIDs {
+		if now.Sub(resolved.Used) > logIDRetention {
+			delete(b.logIDs, id)
+		}
+	}
+}
+
+// apply makes a queued write against the repository. For a session log
+// insert it returns the database ID of the new row.
+func (b *BufferedStore) apply(ctx context.Context, write pendingWrite) (int64, error) {
+	switch write.Op {
+	case writeAddSessionLog:
+		entry := *write.SessionLog
+		entry.ID = 0
+		return b.Repository.AddSessionLogContext(ctx, entry)
+	case writeExtendSessionLog:
+		return 0, b.Repository.ExtendSessionLogContext(ctx, write.LogID, write.Time)
+	case writeSaveOpenSession:
+		return 0, b.Repository.SaveOpenSessionContext(ctx, *write.OpenSession)
+	case writeDeleteOpenSession:
+		session := write.OpenSession
+		return 0, b.Repository.DeleteOpenSessionContext(ctx, session.Kind, session.UserID, session.GuildID, session.Subject)
+	case writeTouchOpenSessions:
+		return 0, b.Repository.TouchOpenSessionsContext(ctx, write.RunID, write.Time)
+	case writeAddListeningSession:
+		return 0, b.Repository.AddListeningSessionContext(ctx, *write.Listening)
+	}
+	return 0, fmt.Errorf("%w %q", errUnknownWrite, write.Op)
+}
+
+// write makes a write directly unless earlier ones are still queued, and
+// queues it if the repository can't be reached. Queued writes report
+// success, like buffered increments; other errors are returned.
+func (b *BufferedStore) write(ctx context.Context, write pendingWrite) (int64, error) {
+	b.mu.Lock()
+	queued := len(b.writes) > 0
+	b.mu.Unlock()
+
+	if !queued {
+		id, err := b.apply(ctx, write)
+		if err == nil || !isRetryable(err) {
+			return id, err
+		}
+		log.Printf("Error writing %s, queued for retry: %v", write.Op, err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if write.Op == writeAddSessionLog {
+		entry := *write.SessionLog
+		entry.ID = b.nextLogID
+		b.nextLogID--
+		write.SessionLog = &entry
+	}
+	b.writes = append(b.writes, write)
+	if write.Op == writeAddSessionLog {
+		return write.SessionLog.ID, nil
+	}
+	return 0, nil
+}
+
+// isRetryable reports whether a failed write may succeed when tried again:
+// the database was unreachable, busy or out of resources, or the call was
+// cancelled or timed out. Errors the database reports about the statement
+// itself, such as constraint violations, are not.
+func isRetryable(err error) bool {
+	if errors.Is(err, errUnknownWrite) {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Class() {
+		case "08", "40", "53", "57", "58": // connection, rollback, resources, operator intervention, system
+			return true
+		}
+		return false
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code {
+		case sqlite3.ErrBusy, sqlite3.ErrLocked, sqlite3.ErrIoErr, sqlite3.ErrFull, sqlite3.ErrCantOpen, sqlite3.ErrNomem:
+			return true
+		}
+		return false
+	}
+
+	// Anything else, such as a closed connection pool, is taken to be the
+	// database being unavailable
+	return true
+}
+
+// add queues an increment, merging it with a pending one for the same row
+func (b *BufferedStore) add(table string, keys []string, values ...int64) error {
+	b.mu.Lock()
+	b.addLocked(Increment{Table: table, Keys: keys, Values: values})
+	full := len(b.pending) >= maxPendingIncrements
+	b.mu.Unlock()
+
+	if full {
+		select {
+		case b.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// addLocked merges an increment into the pending set. The caller must
+// hold mu.
+func (b *BufferedStore) addLocked(increment Increment) {
+	key := increment.Table + "\x00" + strings.Join(increment.Keys, "\x00")
+	if pending, exists := b.pending[key]; exists {
+		for i, value := range increment.Values {
+			pending.Values[i] += value
+		}
+		return
+	}
+
+	increment.Values = append([]int64{}, increment.Values...)
+	b.pending[key] = &increment
+	b.order = append(b.order, key)
+}
+
+// spillFile is the content of the spill file. Files written before
+// queued writes were spilled hold just the increments array.
+type spillFile struct {
+	Increments []Increment    `json:"increments"`
+	Writes     []pendingWrite `json:"writes,omitempty"`
+}
+
+// loadSpill queues increments and writes left in the spill file by a
+// previous run
+func (b *BufferedStore) loadSpill() error {
+	data, err := os.ReadFile(b.spillPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read spill file: %w", err)
+	}
+
+	var spill spillFile
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "[") {
+		err = json.Unmarshal(data, &spill.Increments)
+	} else {
+		err = json.Unmarshal(data, &spill)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse spill file %s: %w", b.spillPath, err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, increment := range spill.Increments {
+		b.addLocked(increment)
+	}
+	for _, write := range spill.Writes {
+		// Keep local session log IDs clear of the spilled ones
+		if write.Op == writeAddSessionLog && write.SessionLog.ID <= b.nextLogID {
+			b.nextLogID = write.SessionLog.ID - 1
+		}
+	}
+	b.writes = append(b.writes, spill.Writes...)
+	b.spilled = true
+	log.Printf("Loaded %d buffered increments and %d queued writes from %s",
+		len(spill.Increments), len(spill.Writes), b.spillPath)
+	return nil
+}
+
+// writeSpillLocked replaces the spill file with the pending increments and
+// queued writes. The caller must hold mu.
+func (b *BufferedStore) writeSpillLocked() error {
+	spill := spillFile{
+		Increments: make([]Increment, 0, len(b.order)),
+		Writes:     b.writes,
+	}
+	for _, key := range b.order {
+		spill.Increments = append(spill.Increments, *b.pending[key])
+	}
+	data, err := json.Marshal(spill)
+	if err != nil {
+		return err
+	}
+
+	tmp := b.spillPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, b.spillPath); err != nil {
+		return err
+	}
+	b.spilled = true
+	return nil
+}
+
+// flushForRead writes pending increments and queued writes so reads see them
+func (b *BufferedStore) flushForRead() {
+	if err := b.Flush(); err != nil {
+		log.Printf("Error flushing buffered increments before read: %v", err)
+	}
+}
+
+// AddVoiceSecondsContext queues voice seconds for a user in a guild
+func (b *BufferedStore) AddVoiceSecondsContext(ctx context.Context, userID, guildID string, seconds int64) error {
+	return b.add("voice_hours", []string{userID, guildID}, seconds)
+}
+
+// AddActivitySecondsContext queues activity seconds for a user
+func (b *BufferedStore) AddActivitySecondsContext(ctx context.Context, userID, activityName string, seconds int64) error {
+	return b.add("activity_hours", []string{userID, activityName}, seconds)
+}
+
+// AddGuildActivitySecondsContext queues activity seconds for a user in a guild
+func (b *BufferedStore) AddGuildActivitySecondsContext(ctx context.Context, userID, guildID, activityName string, seconds int64) error {
+	return b.add("guild_activity_hours", []string{userID, guildID, activityName}, seconds)
+}
+
+// AddChannelSecondsContext queues voice channel seconds for a user in a guild
+func (b *BufferedStore) AddChannelSecondsContext(ctx context.Context, userID, guildID, channelID string, seconds int64) error {
+	return b.add("voice_channel_hours", []string{userID, guildID, channelID}, seconds)
+}
+
+// AddIdleSecondsContext queues voice seconds spent in AFK or ignored channels
+func (b *BufferedStore) AddIdleSecondsContext(ctx context.Context, userID, guildID string, seconds int64) error {
+	return b.add("voice_idle_hours", []string{userID, guildID}, seconds)
+}
+
+// AddVoiceStateSecondsContext queues muted, deafened, go-live and camera seconds
+func (b *BufferedStore) AddVoiceStateSecondsContext(ctx context.Context, userID, guildID string, muted, deafened, streaming, video int64) error {
+	return b.add("voice_state_hours", []string{userID, guildID}, muted, deafened, streaming, video)
+}
+
+// AddDailyStatsContext queues daily statistics
+func (b *BufferedStore) AddDailyStatsContext(ctx context.Context, date, userID, guildID string, voiceSeconds, activitySeconds int64, activityName string) error {
+	return b.add("daily_stats", []string{date, userID, guildID, activityName}, voiceSeconds, activitySeconds)
+}
+
+// AddWeeklyStatsContext queues weekly statistics
+func (b *BufferedStore) AddWeeklyStatsContext(ctx context.Context, weekStart, userID, guildID string, voiceSeconds, activitySeconds int64, activityName string) error {
+	return b.add("weekly_stats", []string{weekStart, userID, guildID, activityName}, voiceSeconds, activitySeconds)
+}
+
+// GetVoiceHoursContext flushes pending increments and gets total voice seconds
+func (b *BufferedStore) GetVoiceHoursContext(ctx context.Context, userID, guildID string) (int64, error) {
+	b.flushForRead()
+	return b.Repository.GetVoiceHoursContext(ctx, userID, guildID)
+}
+
+// GetIdleHoursContext flushes pending increments and gets total idle seconds
+func (b *BufferedStore) GetIdleHoursContext(ctx context.Context, userID, guildID string) (int64, error) {
+	b.flushForRead()
+	return b.Repository.GetIdleHoursContext(ctx, userID, guildID)
+}
+
+// GetVoiceStateHoursContext flushes pending increments and gets the voice state breakdown
+func (b *BufferedStore) GetVoiceStateHoursContext(ctx context.Context, userID, guildID string) (VoiceStateHours, error) {
+	b.flushForRead()
+	return b.Repository.GetVoiceStateHoursContext(ctx, userID, guildID)
+}
+
+// GetActivityHoursContext flushes pending increments and gets total activity seconds
+func (b *BufferedStore) GetActivityHoursContext(ctx context.Context, userID, activityName string) (int64, error) {
+	b.flushForRead()
+	return b.Repository.GetActivityHoursContext(ctx, userID, activityName)
+}
+
+// GetTopActivitiesContext flushes pending increments and gets a user's top activities
+func (b *BufferedStore) GetTopActivitiesContext(ctx context.Context, userID string, limit int) ([]ActivityHours, error) {
+	b.flushForRead()
+	return b.Repository.GetTopActivitiesContext(ctx, userID, limit)
+}
+
+// AddActivityDetailSecondsContext queues seconds spent in a rich presence detail of an activity
+func (b *BufferedStore) AddActivityDetailSecondsContext(ctx context.Context, userID, activityName, detail string, seconds int64) error {
+	return b.add("activity_detail_hours", []string{userID, activityName, detail}, seconds)
+}
+
+// GetActivityDetailHoursContext flushes pending increments and gets time per rich presence detail
+func (b *BufferedStore) GetActivityDetailHoursContext(ctx context.Context, userID, activityName string, limit int) ([]ActivityDetailHours, error) {
+	b.flushForRead()
+	return b.Repository.GetActivityDetailHoursContext(ctx, userID, activityName, limit)
+}
+
+// GetActivityTypeHoursContext flushes pending increments and gets activity time per type
+func (b *BufferedStore) GetActivityTypeHoursContext(ctx context.Context, userID string) ([]ActivityTypeHours, error) {
+	b.flushForRead()
+	return b.Repository.GetActivityTypeHoursContext(ctx, userID)
+}
+
+// GetVoiceChannelHoursContext flushes pending increments and gets voice seconds per channel
+func (b *BufferedStore) GetVoiceChannelHoursContext(ctx context.Context, userID, guildID string) ([]VoiceChannelHours, error) {
+	b.flushForRead()
+	return b.Repository.GetVoiceChannelHoursContext(ctx, userID, guildID)
+}
+
+// GetVoiceLeaderboardContext flushes pending increments and gets the voice leaderboard
+func (b *BufferedStore) GetVoiceLeaderboardContext(ctx context.Context, guildID string, limit int, excludeDeafened bool) ([]LeaderboardEntry, error) {
+	b.flushForRead()
+	return b.Repository.GetVoiceLeaderboardContext(ctx, guildID, limit, excludeDeafened)
+}
+
+// GetActivityLeaderboardContext flushes pending increments and gets an activity leaderboard
+func (b *BufferedStore) GetActivityLeaderboardContext(ctx context.Context, guildID, activityName string, limit int) ([]LeaderboardEntry, error) {
+	b.flushForRead()
+	return b.Repository.GetActivityLeaderboardContext(ctx, guildID, activityName, limit)
+}
+
+// GetUserComparisonContext flushes pending increments and gets comparison data
+func (b *BufferedStore) GetUserComparisonContext(ctx context.Context, userID1, userID2, guildID string) ([]UserComparison, error) {
+	b.flushForRead()
+	return b.Repository.GetUserComparisonContext(ctx, userID1, userID2, guildID)
+}
+
+// GetWeeklyReportContext flushes pending increments and gets a weekly report
+func (b *BufferedStore) GetWeeklyReportContext(ctx context.Context, userID, guildID string, weekStart string) ([]WeeklyStats, error) {
+	b.flushForRead()
+	return b.Repository.GetWeeklyReportContext(ctx, userID, guildID, weekStart)
+}
+
+// GetMonthlyReportContext flushes pending increments and gets a monthly report
+func (b *BufferedStore) GetMonthlyReportContext(ctx context.Context, userID, guildID, since string) ([]WeeklyStats, error) {
+	b.flushForRead()
+	return b.Repository.GetMonthlyReportContext(ctx, userID, guildID, since)
+}
+
+// AddTrackSecondsContext queues listening seconds of a track for a user
+func (b *BufferedStore) AddTrackSecondsContext(ctx context.Context, userID, artist, track string, seconds int64) error {
+	return b.add("track_hours", []string{userID, artist, track}, seconds)
+}
+
+// AddGuildTrackSecondsContext queues listening seconds of a track for a user in a guild
+func (b *BufferedStore) AddGuildTrackSecondsContext(ctx context.Context, userID, guildID, artist, track string, seconds int64) error {
+	return b.add("guild_track_hours", []string{userID, guildID, artist, track}, seconds)
+}
+
+// GetTopArtistsContext flushes pending increments and gets the most listened artists
+func (b *BufferedStore) GetTopArtistsContext(ctx context.Context, userID, guildID string, limit int) ([]TrackHours, error) {
+	b.flushForRead()
+	return b.Repository.GetTopArtistsContext(ctx, userID, guildID, limit)
+}
+
+// GetTopTracksContext flushes pending increments and gets the most listened tracks
+func (b *BufferedStore) GetTopTracksContext(ctx context.Context, userID, guildID string, limit int) ([]TrackHours, error) {
+	b.flushForRead()
+	return b.Repository.GetTopTracksContext(ctx, userID, guildID, limit)
+}
+
+// AddSessionLogContext logs a session stretch, queueing it if the database
+// can't be reached. A queued entry gets a local ID that ExtendSessionLogContext
+// accepts.
+func (b *BufferedStore) AddSessionLogContext(ctx context.Context, entry SessionLog) (int64, error) {
+	return b.write(ctx, pendingWrite{Op: writeAddSessionLog, SessionLog: &entry})
+}
+
+// ExtendSessionLogContext moves the end of a logged session stretch, queueing
+// it if the database can't be reached
+func (b *BufferedStore) ExtendSessionLogContext(ctx context.Context, id int64, endedAt time.Time) error {
+	if id < 0 {
+		b.mu.Lock()
+		if resolved, exists := b.logIDs[id]; exists {
+			resolved.Used = time.Now()
+			b.logIDs[id] = resolved
+			id = resolved.ID
+		} else {
+			// The insert is still queued, so the extend queues behind it
+			b.writes = append(b.writes, pendingWrite{Op: writeExtendSessionLog, LogID: id, Time: endedAt})
+			b.mu.Unlock()
+			return nil
+		}
+		b.mu.Unlock()
+	}
+	_, err := b.write(ctx, pendingWrite{Op: writeExtendSessionLog, LogID: id, Time: endedAt})
+	return err
+}
+
+// GetRecentSessionLogsContext flushes queued writes and gets a user's recent session logs
+func (b *BufferedStore) GetRecentSessionLogsContext(ctx context.Context, userID, guildID string, limit int) ([]SessionLog, error) {
+	b.flushForRead()
+	return b.Repository.GetRecentSessionLogsContext(ctx, userID, guildID, limit)
+}
+
+// SaveOpenSessionContext stores an in-flight session, queueing it if the
+// database can't be reached
+func (b *BufferedStore) SaveOpenSessionContext(ctx context.Context, session OpenSession) error {
+	_, err := b.write(ctx, pendingWrite{Op: writeSaveOpenSession, OpenSession: &session})
+	return err
+}
+
+// DeleteOpenSessionContext removes an in-flight session, queueing it if the
+// database can't be reached
+func (b *BufferedStore) DeleteOpenSessionContext(ctx context.Context, kind, userID, guildID, subject string) error {
+	session := OpenSession{Kind: kind, UserID: userID, GuildID: guildID, Subject: subject}
+	_, err := b.write(ctx, pendingWrite{Op: writeDeleteOpenSession, OpenSession: &session})
+	return err
+}
+
+// TouchOpenSessionsContext records a heartbeat for the in-flight sessions
+// saved by a run, queueing it if the database can't be reached
+func (b *BufferedStore) TouchOpenSessionsContext(ctx context.Context, runID string, lastSeen time.Time) error {
+	_, err := b.write(ctx, pendingWrite{Op: writeTouchOpenSessions, RunID: runID, Time: lastSeen})
+	return err
+}
+
+// GetOpenSessionsContext flushes queued writes and gets the in-flight sessions
+func (b *BufferedStore) GetOpenSessionsContext(ctx context.Context) ([]OpenSession, error) {
+	b.flushForRead()
+	return b.Repository.GetOpenSessionsContext(ctx)
+}
+
+// AddListeningSessionContext records a played track, queueing it if the
+// database can't be reached
+func (b *BufferedStore) AddListeningSessionContext(ctx context.Context, entry ListeningSession) error {
+	_, err := b.write(ctx, pendingWrite{Op: writeAddListeningSession, Listening: &entry})
+	return err
+}
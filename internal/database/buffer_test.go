@@ -0,0 +1,159 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestBuffer wraps a test repository in a BufferedStore that only
+// flushes when asked to
+func newTestBuffer(t *testing.T) (*BufferedStore, *Repository, string) {
+	t.Helper()
+	repository := newTestRepository(t)
+	spillPath := filepath.Join(t.TempDir(), "spill.json")
+	buffer, err := NewBufferedStore(repository, time.Hour, spillPath)
+	if err != nil {
+		t.Fatalf("NewBufferedStore: %v", err)
+	}
+	return buffer, repository, spillPath
+}
+
+// disconnect makes the repository's database unreachable until the
+// returned function is called
+func disconnect(t *testing.T, repository *Repository) func() {
+	t.Helper()
+	conn := repository.db.conn
+	closed, err := sql.Open(DialectSQLite, ":memory:")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	closed.Close()
+	repository.db.conn = closed
+	return func() { repository.db.conn = conn }
+}
+
+func TestBufferedStoreCoalescesIncrements(t *testing.T) {
+	buffer, repository, _ := newTestBuffer(t)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		buffer.AddVoiceSecondsContext(ctx, "u1", "g1", 60)
+	}
+	buffer.AddVoiceSecondsContext(ctx, "u2", "g1", 30)
+
+	if len(buffer.pending) != 2 {
+		t.Errorf("pending increments = %d, want 2", len(buffer.pending))
+	}
+	if err := buffer.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if total, _ := repository.GetVoiceHoursContext(ctx, "u1", "g1"); total != 180 {
+		t.Errorf("u1 voice hours = %d, want 180", total)
+	}
+	if total, _ := repository.GetVoiceHoursContext(ctx, "u2", "g1"); total != 30 {
+		t.Errorf("u2 voice hours = %d, want 30", total)
+	}
+}
+
+func TestBufferedStoreReplaysWritesInOrder(t *testing.T) {
+	buffer, repository, _ := newTestBuffer(t)
+	ctx := context.Background()
+	start := time.Date(2026, 1, 5, 10, 0, 0, 0, time.UTC)
+	open := OpenSession{Kind: SessionKindVoice, UserID: "u1", GuildID: "g1", Subject: "c1", StartedAt: start, CreditedUntil: start, LastSeen: start}
+
+	reconnect := disconnect(t, repository)
+	id, err := buffer.AddSessionLogContext(ctx, SessionLog{Kind: SessionKindVoice, UserID: "u1", GuildID: "g1", Subject: "c1", StartedAt: start, EndedAt: start.Add(time.Minute)})
+	if err != nil || id >= 0 {
+		t.Fatalf("AddSessionLogContext = %d, %v, want a local ID", id, err)
+	}
+	buffer.ExtendSessionLogContext(ctx, id, start.Add(time.Hour))
+	buffer.SaveOpenSessionContext(ctx, open)
+	buffer.DeleteOpenSessionContext(ctx, open.Kind, open.UserID, open.GuildID, open.Subject)
+	reconnect()
+
+	if err := buffer.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if sessions, _ := repository.GetOpenSessionsContext(ctx); len(sessions) != 0 {
+		t.Errorf("open sessions = %+v, want the delete replayed after the save", sessions)
+	}
+
+	// The local ID still extends the row once it is written
+	buffer.ExtendSessionLogContext(ctx, id, start.Add(2*time.Hour))
+	logs, _ := repository.GetRecentSessionLogsContext(ctx, "u1", "g1", 10)
+	if len(logs) != 1 || !logs[0].EndedAt.Equal(start.Add(2*time.Hour)) {
+		t.Errorf("session logs = %+v, want one row ending at %s", logs, start.Add(2*time.Hour))
+	}
+}
+
+func TestBufferedStoreSpillReload(t *testing.T) {
+	buffer, repository, spillPath := newTestBuffer(t)
+	ctx := context.Background()
+	start := time.Date(2026, 1, 5, 10, 0, 0, 0, time.UTC)
+
+	reconnect := disconnect(t, repository)
+	buffer.AddVoiceSecondsContext(ctx, "u1", "g1", 600)
+	buffer.AddSessionLogContext(ctx, SessionLog{Kind: SessionKindVoice, UserID: "u1", GuildID: "g1", Subject: "c1", StartedAt: start, EndedAt: start.Add(10 * time.Minute)})
+	if err := buffer.Close(); err == nil {
+		t.Fatal("Close succeeded with the database unreachable")
+	}
+	if _, err := os.Stat(spillPath); err != nil {
+		t.Fatalf("spill file: %v", err)
+	}
+	reconnect()
+
+	reloaded, err := NewBufferedStore(repository, time.Hour, spillPath)
+	if err != nil {
+		t.Fatalf("NewBufferedStore: %v", err)
+	}
+	defer reloaded.Close()
+
+	if total, _ := repository.GetVoiceHoursContext(ctx, "u1", "g1"); total != 600 {
+		t.Errorf("voice hours = %d, want 600", total)
+	}
+	if logs, _ := repository.GetRecentSessionLogsContext(ctx, "u1", "g1", 10); len(logs) != 1 {
+		t.Errorf("session logs = %+v, want 1", logs)
+	}
+	if _, err := os.Stat(spillPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("spill file still present after reload: %v", err)
+	}
+}
+
+func TestBufferedStoreFailingWriteDoesNotBlockIncrements(t *testing.T) {
+	buffer, repository, _ := newTestBuffer(t)
+	ctx := context.Background()
+	start := time.Date(2026, 1, 5, 10, 0, 0, 0, time.UTC)
+	listening := ListeningSession{UserID: "u1", Track: "Song", Artist: "Artist", StartedAt: start, EndedAt: start.Add(3 * time.Minute)}
+
+	// Queued while the database is unreachable, then rejected for good
+	reconnect := disconnect(t, repository)
+	buffer.AddListeningSessionContext(ctx, listening)
+	buffer.AddVoiceSecondsContext(ctx, "u1", "g1", 60)
+	reconnect()
+	if _, err := repository.db.conn.Exec("DROP TABLE listening_sessions"); err != nil {
+		t.Fatalf("dropping listening_sessions: %v", err)
+	}
+
+	if err := buffer.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if total, _ := repository.GetVoiceHoursContext(ctx, "u1", "g1"); total != 60 {
+		t.Errorf("voice hours = %d, want 60", total)
+	}
+	if len(buffer.writes) != 0 {
+		t.Errorf("queued writes = %+v, want the rejected write dropped", buffer.writes)
+	}
+
+	// Rejected writes are returned instead of queued
+	if err := buffer.AddListeningSessionContext(ctx, listening); err == nil {
+		t.Error("AddListeningSessionContext succeeded without its table")
+	}
+	if len(buffer.writes) != 0 {
+		t.Errorf("queued writes = %+v, want none", buffer.writes)
+	}
+}
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Increment adds Values to the value columns of the row identified by Keys
+// in one of the aggregate tables
+type Increment struct {
+	Table  string   `json:"table"`
+	Keys   []string `json:"keys"`
+	Values []int64  `json:"values"`
+}
+
+// incrementTable describes the key and value columns of an aggregate table
+type incrementTable struct {
+	keys   []string
+	values []string
+}
+
+// incrementTables lists the aggregate tables that can be incremented
+var incrementTables = map[string]incrementTable{
+	"voice_hours":           {[]string{"user_id", "guild_id"}, []string{"total_seconds"}},
+	"voice_idle_hours":      {[]string{"user_id", "guild_id"}, []string{"total_seconds"}},
+	"voice_channel_hours":   {[]string{"user_id", "guild_id", "channel_id"}, []string{"total_seconds"}},
+	"activity_hours":        {[]string{"user_id", "activity_name"}, []string{"total_seconds"}},
+	"guild_activity_hours":  {[]string{"user_id", "guild_id", "activity_name"}, []string{"total_seconds"}},
+	"activity_detail_hours": {[]string{"user_id", "activity_name", "detail"}, []string{"total_seconds"}},
+	"track_hours":           {[]string{"user_id", "artist", "track"}, []string{"total_seconds"}},
+	"guild_track_hours":     {[]string{"user_id", "guild_id", "artist", "track"}, []string{"total_seconds"}},
+	"voice_state_hours": {[]string{"user_id", "guild_id"},
+		[]string{"muted_seconds", "deafened_seconds", "streaming_seconds", "video_seconds"}},
+	"daily_stats": {[]string{"date", "user_id", "guild_id", "activity_name"},
+		[]string{"voice_seconds", "activity_seconds"}},
+	"weekly_stats": {[]string{"week_start", "user_id", "guild_id", "activity_name"},
+		[]string{"voice_seconds", "activity_seconds"}},
+}
+
+// upsert builds the statement adding an increment to a table
+func (t incrementTable) upsert(table string) string {
+	columns := append(append([]string{}, t.keys...), t.values...)
+	placeholders := make([]string, len(columns))
+	for i := range columns {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+	updates := make([]string, len(t.values))
+	for i, column := range t.values {
+		updates[i] = fmt.Sprintf("%s = %s.%s + EXCLUDED.%s", column, table, column, column)
+	}
+
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (%s) DO UPDATE SET %s",
+		table, strings.Join(columns, ", "), strings.Join(placeholders, ", "),
+		strings.Join(t.keys, ", "), strings.Join(updates, ", "))
+}
+
+// ApplyIncrements adds a batch of increments in a single transaction, so
+// either all or none of them are written. The whole batch is bounded by
+// the query timeout.
+func (r *Repository) ApplyIncrements(ctx context.Context, increments []Increment) error {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := r.db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin increments: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, increment := range increments {
+		table, exists := incrementTables[increment.Table]
+		if !exists || len(increment.Keys) != len(table.keys) || len(increment.Values) != len(table.values) {
+			return fmt.Errorf("invalid increment for table %q", increment.Table)
+		}
+
+		args := make([]interface{}, 0, len(increment.Keys)+len(increment.Values))
+		for _, key := range increment.Keys {
+			args = append(args, key)
+		}
+		for _, value := range increment.Values {
+			args = append(args, value)
+		}
+		if _, err := tx.ExecContext(ctx, r.db.rebind(table.upsert(increment.Table)), args...); err != nil {
+			return fmt.Errorf("failed to apply increment to %s: %w", increment.Table, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit increments: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,766 @@
+package database
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// userGuildKey identifies per-user, per-guild rows
+type userGuildKey struct {
+	userID, guildID string
+}
+
+// trackKey identifies a track of an artist
+type trackKey struct {
+	artist, track string
+}
+
+// MemoryStore is a Store that keeps everything in memory, for running the
+// bot's logic without a database. It is safe for concurrent use.
+type MemoryStore struct {
+	mu sync.Mutex
+
+	voice           map[userGuildKey]int64
+	idle            map[userGuildKey]int64
+	states          map[userGuildKey]VoiceStateHours
+	channels        map[userGuildKey]map[string]int64 // channel ID -> seconds
+	activities      map[string]map[string]int64       // user ID -> activity name -> seconds
+	guildActivities map[userGuildKey]map[string]int64 // activity name -> seconds
+	daily           map[periodKey][2]int64            // voice and activity seconds
+	weekly          map[periodKey][2]int64            // voice and activity seconds
+	openSessions    map[string]OpenSession            // key: kind:userID:guildID:subject
+	sessionLogs     []SessionLog
+	guilds          map[string]GuildSettings
+	users           map[string]UserSettings
+	ignored         map[string]map[string]bool   // guild ID -> ignored channel IDs
+	aliases         map[string]map[string]string // guild ID -> alias -> activity name
+	activityTypes   map[string]string            // activity name -> activity type
+	listening       []ListeningSession
+	tracks          map[string]map[trackKey]int64       // user ID -> seconds
+	guildTracks     map[userGuildKey]map[trackKey]int64 // seconds
+	details         map[string]map[trackKey]int64       // user ID -> activity name and detail -> seconds
+	detailGames     map[string]map[string]bool          // guild ID -> activity keys with tracked details
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		voice:           make(map[userGuildKey]int64),
+		idle:            make(map[userGuildKey]int64),
+		states:          make(map[userGuildKey]VoiceStateHours),
+		channels:        make(map[userGuildKey]map[string]int64),
+		activities:      make(map[string]map[string]int64),
+		guildActivities: make(map[userGuildKey]map[string]int64),
+		daily:           make(map[periodKey][2]int64),
+		weekly:          make(map[periodKey][2]int64),
+		openSessions:    make(map[string]OpenSession),
+		guilds:          make(map[string]GuildSettings),
+		users:           make(map[string]UserSettings),
+		ignored:         make(map[string]map[string]bool),
+		aliases:         make(map[string]map[string]string),
+		activityTypes:   make(map[string]string),
+		tracks:          make(map[string]map[trackKey]int64),
+		guildTracks:     make(map[userGuildKey]map[trackKey]int64),
+		details:         make(map[string]map[trackKey]int64),
+		detailGames:     make(map[string]map[string]bool),
+	}
+}
+
+// AddVoiceSecondsContext adds voice seconds for a user in a guild
+func (m *MemoryStore) AddVoiceSecondsContext(ctx context.Context, userID, guildID string, seconds int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.voice[userGuildKey{userID, guildID}] += seconds
+	return nil
+}
+
+// AddActivitySecondsContext adds activity seconds for a user
+func (m *MemoryStore) AddActivitySecondsContext(ctx context.Context, userID, activityName string, seconds int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.activities[userID] == nil {
+		m.activities[userID] = make(map[string]int64)
+	}
+	m.activities[userID][activityName] += seconds
+	return nil
+}
+
+// AddGuildActivitySecondsContext adds activity seconds for a user in a guild
+func (m *MemoryStore) AddGuildActivitySecondsContext(ctx context.Context, userID, guildID, activityName string, seconds int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := userGuildKey{userID, guildID}
+	if m.guildActivities[key] == nil {
+		m.guildActivities[key] = make(map[string]int64)
+	}
+	m.guildActivities[key][activityName] += seconds
+	return nil
+}
+
+// AddChannelSecondsContext adds voice channel seconds for a user in a guild
+func (m *MemoryStore) AddChannelSecondsContext(ctx context.Context, userID, guildID, channelID string, seconds int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := userGuildKey{userID, guildID}
+	if m.channels[key] == nil {
+		m.channels[key] = make(map[string]int64)
+	}
+	m.channels[key][channelID] += seconds
+	return nil
+}
+
+// AddIdleSecondsContext adds voice seconds spent in AFK or ignored channels
+func (m *MemoryStore) AddIdleSecondsContext(ctx context.Context, userID, guildID string, seconds int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.idle[userGuildKey{userID, guildID}] += seconds
+	return nil
+}
+
+// AddVoiceStateSecondsContext adds muted, deafened, go-live and camera seconds
+func (m *MemoryStore) AddVoiceStateSecondsContext(ctx context.Context, userID, guildID string, muted, deafened, streaming, video int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := userGuildKey{userID, guildID}
+	stats := m.states[key]
+	stats.UserID, stats.GuildID = userID, guildID
+	stats.MutedSeconds += muted
+	stats.DeafenedSeconds += deafened
+	stats.StreamingSeconds += streaming
+	stats.VideoSeconds += video
+	m.states[key] = stats
+	return nil
+}
+
+// GetVoiceHoursContext gets total voice seconds for a user in a guild
+func (m *MemoryStore) GetVoiceHoursContext(ctx context.Context, userID, guildID string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.voice[userGuildKey{userID, guildID}], nil
+}
+
+// GetIdleHoursContext gets total idle voice seconds for a user in a guild
+func (m *MemoryStore) GetIdleHoursContext(ctx context.Context, userID, guildID string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.idle[userGuildKey{userID, guildID}], nil
+}
+
+// GetVoiceStateHoursContext gets the voice state breakdown for a user in a guild
+func (m *MemoryStore) GetVoiceStateHoursContext(ctx context.Context, userID, guildID string) (VoiceStateHours, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := m.states[userGuildKey{userID, guildID}]
+	stats.UserID, stats.GuildID = userID, guildID
+	return stats, nil
+}
+
+// GetActivityHoursContext gets total seconds for a user and activity
+func (m *MemoryStore) GetActivityHoursContext(ctx context.Context, userID, activityName string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var total int64
+	for name, seconds := range m.activities[userID] {
+		if strings.EqualFold(name, activityName) {
+			total += seconds
+		}
+	}
+	return total, nil
+}
+
+// GetTopActivitiesContext gets a user's activities with the most time
+func (m *MemoryStore) GetTopActivitiesContext(ctx context.Context, userID string, limit int) ([]ActivityHours, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Names differing only in case are the same activity, listed under
+	// the lowest of their names like the repository does
+	byKey := make(map[string]*ActivityHours)
+	for name, seconds := range m.activities[userID] {
+		key := strings.ToLower(name)
+		activity, exists := byKey[key]
+		if !exists {
+			activity = &ActivityHours{UserID: userID, ActivityName: name}
+			byKey[key] = activity
+		}
+		if name < activity.ActivityName {
+			activity.ActivityName = name
+		}
+		activity.TotalSeconds += seconds
+	}
+
+	var activities []ActivityHours
+	for _, activity := range byKey {
+		activities = append(activities, *activity)
+	}
+	sort.Slice(activities, func(i, j int) bool {
+		if activities[i].TotalSeconds != activities[j].TotalSeconds {
+			return activities[i].TotalSeconds > activities[j].TotalSeconds
+		}
+		return activities[i].ActivityName < activities[j].ActivityName
+	})
+	if len(activities) > limit {
+		activities = activities[:limit]
+	}
+	return activities, nil
+}
+
+// GetActivityTypeHoursContext gets a user's total activity time per type
+func (m *MemoryStore) GetActivityTypeHoursContext(ctx context.Context, userID string) ([]ActivityTypeHours, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Types are matched case-insensitively, one type per name like the
+	// repository does
+	typesByKey := make(map[string]string)
+	for name, activityType := range m.activityTypes {
+		key := strings.ToLower(name)
+		if activityType > typesByKey[key] {
+			typesByKey[key] = activityType
+		}
+	}
+
+	totals := make(map[string]int64)
+	for name, seconds := range m.activities[userID] {
+		activityType, exists := typesByKey[strings.ToLower(name)]
+		if !exists {
+			activityType = ActivityTypePlaying
+		}
+		totals[activityType] += seconds
+	}
+
+	var types []ActivityTypeHours
+	for activityType, seconds := range totals {
+		types = append(types, ActivityTypeHours{ActivityType: activityType, TotalSeconds: seconds})
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i].TotalSeconds > types[j].TotalSeconds })
+	return types, nil
+}
+
+// GetVoiceChannelHoursContext gets voice seconds per channel for a user in a guild
+func (m *MemoryStore) GetVoiceChannelHoursContext(ctx context.Context, userID, guildID string) ([]VoiceChannelHours, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.channelHours(userID, guildID), nil
+}
+
+// channelHours lists a user's channel totals, most time first. The caller
+// must hold mu.
+func (m *MemoryStore) channelHours(userID, guildID string) []VoiceChannelHours {
+	var channelHours []VoiceChannelHours
+	for channelID, seconds := range m.channels[userGuildKey{userID, guildID}] {
+		channelHours = append(channelHours, VoiceChannelHours{
+			UserID:       userID,
+			GuildID:      guildID,
+			ChannelID:    channelID,
+			TotalSeconds: seconds,
+		})
+	}
+	sort.Slice(channelHours, func(i, j int) bool {
+		if channelHours[i].TotalSeconds != channelHours[j].TotalSeconds {
+			return channelHours[i].TotalSeconds > channelHours[j].TotalSeconds
+		}
+		return channelHours[i].ChannelID < channelHours[j].ChannelID
+	})
+	return channelHours
+}
+
+// AddDailyStatsContext adds daily statistics
+func (m *MemoryStore) AddDailyStatsContext(ctx context.Context, date, userID, guildID string, voiceSeconds, activitySeconds int64, activityName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := periodKey{date, userID, guildID, activityName}
+	totals := m.daily[key]
+	totals[0] += voiceSeconds
+	totals[1] += activitySeconds
+	m.daily[key] = totals
+	return nil
+}
+
+// AddWeeklyStatsContext adds weekly statistics
+func (m *MemoryStore) AddWeeklyStatsContext(ctx context.Context, weekStart, userID, guildID string, voiceSeconds, activitySeconds int64, activityName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := periodKey{weekStart, userID, guildID, activityName}
+	totals := m.weekly[key]
+	totals[0] += voiceSeconds
+	totals[1] += activitySeconds
+	m.weekly[key] = totals
+	return nil
+}
+
+// GetVoiceLeaderboardContext gets the voice leaderboard for a guild, optionally
+// leaving out time spent deafened
+func (m *MemoryStore) GetVoiceLeaderboardContext(ctx context.Context, guildID string, limit int, excludeDeafened bool) ([]LeaderboardEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var entries []LeaderboardEntry
+	for key, seconds := range m.voice {
+		if key.guildID != guildID {
+			continue
+		}
+		if excludeDeafened {
+			seconds -= m.states[key].DeafenedSeconds
+		}
+		entries = append(entries, LeaderboardEntry{UserID: key.userID, TotalSeconds: seconds})
+	}
+	return rankEntries(entries, limit), nil
+}
+
+// GetActivityLeaderboardContext gets the leaderboard for an activity in a
+// guild, or across all guilds when guildID is empty
+func (m *MemoryStore) GetActivityLeaderboardContext(ctx context.Context, guildID, activityName string, limit int) ([]LeaderboardEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	totals := make(map[string]int64)
+	add := func(userID string, activities map[string]int64) {
+		for name, seconds := range activities {
+			if strings.EqualFold(name, activityName) {
+				totals[userID] += seconds
+			}
+		}
+	}
+	if guildID != "" {
+		for key, activities := range m.guildActivities {
+			if key.guildID == guildID {
+				add(key.userID, activities)
+			}
+		}
+	} else {
+		for userID, activities := range m.activities {
+			add(userID, activities)
+		}
+	}
+
+	var entries []LeaderboardEntry
+	for userID, seconds := range totals {
+		entries = append(entries, LeaderboardEntry{UserID: userID, TotalSeconds: seconds})
+	}
+	return rankEntries(entries, limit), nil
+}
+
+// rankEntries sorts leaderboard entries by time, keeps the top limit and
+// numbers them
+func rankEntries(entries []LeaderboardEntry, limit int) []LeaderboardEntry {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].TotalSeconds != entries[j].TotalSeconds {
+			return entries[i].TotalSeconds > entries[j].TotalSeconds
+		}
+		return entries[i].UserID < entries[j].UserID
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	for i := range entries {
+		entries[i].Rank = i + 1
+	}
+	return entries
+}
+
+// GetUserComparisonContext gets comparison data for two users
+func (m *MemoryStore) GetUserComparisonContext(ctx context.Context, userID1, userID2, guildID string) ([]UserComparison, error) {
+	var comparisons []UserComparison
+	for _, userID := range []string{userID1, userID2} {
+		voiceSeconds, _ := m.GetVoiceHoursContext(ctx, userID, guildID)
+		activities, _ := m.GetTopActivitiesContext(ctx, userID, 3)
+		channelHours, _ := m.GetVoiceChannelHoursContext(ctx, userID, guildID)
+		comparisons = append(comparisons, UserComparison{
+			UserID:        userID,
+			VoiceSeconds:  voiceSeconds,
+			TopActivities: activities,
+			ChannelHours:  channelHours,
+		})
+	}
+	return comparisons, nil
+}
+
+// GetWeeklyReportContext gets the weekly report for a user
+func (m *MemoryStore) GetWeeklyReportContext(ctx context.Context, userID, guildID string, weekStart string) ([]WeeklyStats, error) {
+	stats := m.weeklyStats(func(key periodKey) bool {
+		return key.userID == userID && key.guildID == guildID && key.period == weekStart
+	})
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].VoiceSeconds != stats[j].VoiceSeconds {
+			return stats[i].VoiceSeconds > stats[j].VoiceSeconds
+		}
+		return stats[i].ActivitySeconds > stats[j].ActivitySeconds
+	})
+	return stats, nil
+}
+
+// GetMonthlyReportContext gets the weekly stats for a user for weeks starting on
+// or after since
+func (m *MemoryStore) GetMonthlyReportContext(ctx context.Context, userID, guildID, since string) ([]WeeklyStats, error) {
+	stats := m.weeklyStats(func(key periodKey) bool {
+		return key.userID == userID && key.guildID == guildID && key.period >= since
+	})
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].WeekStart > stats[j].WeekStart
+	})
+	return stats, nil
+}
+
+// weeklyStats lists the weekly stats rows matching a filter
+func (m *MemoryStore) weeklyStats(match func(periodKey) bool) []WeeklyStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var stats []WeeklyStats
+	for key, totals := range m.weekly {
+		if !match(key) {
+			continue
+		}
+		stats = append(stats, WeeklyStats{
+			WeekStart:       key.period,
+			UserID:          key.userID,
+			GuildID:         key.guildID,
+			VoiceSeconds:    totals[0],
+			ActivitySeconds: totals[1],
+			ActivityName:    key.activityName,
+		})
+	}
+	return stats
+}
+
+// openSessionKey builds the lookup key for an open session
+func openSessionKey(kind, userID, guildID, subject string) string {
+	return kind + ":" + userID + ":" + guildID + ":" + subject
+}
+
+// SaveOpenSessionContext stores or updates an in-flight session
+func (m *MemoryStore) SaveOpenSessionContext(ctx context.Context, session OpenSession) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.openSessions[openSessionKey(session.Kind, session.UserID, session.GuildID, session.Subject)] = session
+	return nil
+}
+
+// DeleteOpenSessionContext removes an in-flight session once it has been closed
+func (m *MemoryStore) DeleteOpenSessionContext(ctx context.Context, kind, userID, guildID, subject string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.openSessions, openSessionKey(kind, userID, guildID, subject))
+	return nil
+}
+
+// TouchOpenSessionsContext records a heartbeat for the in-flight sessions
+// saved by a run
+func (m *MemoryStore) TouchOpenSessionsContext(ctx context.Context, runID string, lastSeen time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, session := range m.openSessions {
+		if session.RunID != runID {
+			continue
+		}
+		session.LastSeen = lastSeen
+		m.openSessions[key] = session
+	}
+	return nil
+}
+
+// GetOpenSessionsContext gets all in-flight sessions
+func (m *MemoryStore) GetOpenSessionsContext(ctx context.Context) ([]OpenSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var sessions []OpenSession
+	for _, session := range m.openSessions {
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+// AddSessionLogContext records a session stretch and returns its ID
+func (m *MemoryStore) AddSessionLogContext(ctx context.Context, entry SessionLog) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry.ID = int64(len(m.sessionLogs) + 1)
+	m.sessionLogs = append(m.sessionLogs, entry)
+	return entry.ID, nil
+}
+
+// ExtendSessionLogContext moves the end of a logged session stretch
+func (m *MemoryStore) ExtendSessionLogContext(ctx context.Context, id int64, endedAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if id >= 1 && id <= int64(len(m.sessionLogs)) {
+		m.sessionLogs[id-1].EndedAt = endedAt
+	}
+	return nil
+}
+
+// GetRecentSessionLogsContext gets a user's most recent logged stretches in a guild
+func (m *MemoryStore) GetRecentSessionLogsContext(ctx context.Context, userID, guildID string, limit int) ([]SessionLog, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var entries []SessionLog
+	for _, entry := range m.sessionLogs {
+		if entry.UserID == userID && entry.GuildID == guildID {
+			entries = append(entries, entry)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].StartedAt.After(entries[j].StartedAt)
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+// GetGuildSettingsContext gets the settings for a guild, or defaults if none are stored
+func (m *MemoryStore) GetGuildSettingsContext(ctx context.Context, guildID string) (GuildSettings, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if settings, exists := m.guilds[guildID]; exists {
+		return settings, nil
+	}
+	return GuildSettings{GuildID: guildID, MinHumans: 1}, nil
+}
+
+// SaveGuildSettingsContext stores the settings for a guild
+func (m *MemoryStore) SaveGuildSettingsContext(ctx context.Context, settings GuildSettings) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.guilds[settings.GuildID] = settings
+	return nil
+}
+
+// GetUserSettingsContext gets the settings for a user, or defaults if none are stored
+func (m *MemoryStore) GetUserSettingsContext(ctx context.Context, userID string) (UserSettings, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if settings, exists := m.users[userID]; exists {
+		return settings, nil
+	}
+	return UserSettings{UserID: userID}, nil
+}
+
+// SaveUserSettingsContext stores the settings for a user
+func (m *MemoryStore) SaveUserSettingsContext(ctx context.Context, settings UserSettings) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users[settings.UserID] = settings
+	return nil
+}
+
+// GetIgnoredChannelsContext gets the voice channels excluded from stats in a guild
+func (m *MemoryStore) GetIgnoredChannelsContext(ctx context.Context, guildID string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var channelIDs []string
+	for channelID := range m.ignored[guildID] {
+		channelIDs = append(channelIDs, channelID)
+	}
+	sort.Strings(channelIDs)
+	return channelIDs, nil
+}
+
+// AddIgnoredChannelContext excludes a voice channel from stats in a guild
+func (m *MemoryStore) AddIgnoredChannelContext(ctx context.Context, guildID, channelID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ignored[guildID] == nil {
+		m.ignored[guildID] = make(map[string]bool)
+	}
+	m.ignored[guildID][channelID] = true
+	return nil
+}
+
+// RemoveIgnoredChannelContext includes a previously ignored voice channel in stats again
+func (m *MemoryStore) RemoveIgnoredChannelContext(ctx context.Context, guildID, channelID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.ignored[guildID], channelID)
+	return nil
+}
+
+// GetActivityAliasesContext gets the activity aliases of a guild
+func (m *MemoryStore) GetActivityAliasesContext(ctx context.Context, guildID string) ([]ActivityAlias, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var aliases []ActivityAlias
+	for alias, activityName := range m.aliases[guildID] {
+		aliases = append(aliases, ActivityAlias{GuildID: guildID, Alias: alias, ActivityName: activityName})
+	}
+	sort.Slice(aliases, func(i, j int) bool { return aliases[i].Alias < aliases[j].Alias })
+	return aliases, nil
+}
+
+// SaveActivityAliasContext creates or replaces an activity alias
+func (m *MemoryStore) SaveActivityAliasContext(ctx context.Context, alias ActivityAlias) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.aliases[alias.GuildID] == nil {
+		m.aliases[alias.GuildID] = make(map[string]string)
+	}
+	m.aliases[alias.GuildID][alias.Alias] = alias.ActivityName
+	return nil
+}
+
+// DeleteActivityAliasContext removes an activity alias from a guild
+func (m *MemoryStore) DeleteActivityAliasContext(ctx context.Context, guildID, alias string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.aliases[guildID], alias)
+	return nil
+}
+
+// SaveActivityTypeContext records the type of an activity
+func (m *MemoryStore) SaveActivityTypeContext(ctx context.Context, activityName, activityType string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.activityTypes[activityName] = activityType
+	return nil
+}
+
+// AddListeningSessionContext records a played track in the listening history
+func (m *MemoryStore) AddListeningSessionContext(ctx context.Context, entry ListeningSession) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.listening = append(m.listening, entry)
+	return nil
+}
+
+// AddTrackSecondsContext adds listening seconds of a track for a user
+func (m *MemoryStore) AddTrackSecondsContext(ctx context.Context, userID, artist, track string, seconds int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tracks[userID] == nil {
+		m.tracks[userID] = make(map[trackKey]int64)
+	}
+	m.tracks[userID][trackKey{artist, track}] += seconds
+	return nil
+}
+
+// AddGuildTrackSecondsContext adds listening seconds of a track for a user in a guild
+func (m *MemoryStore) AddGuildTrackSecondsContext(ctx context.Context, userID, guildID, artist, track string, seconds int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := userGuildKey{userID, guildID}
+	if m.guildTracks[key] == nil {
+		m.guildTracks[key] = make(map[trackKey]int64)
+	}
+	m.guildTracks[key][trackKey{artist, track}] += seconds
+	return nil
+}
+
+// GetTopArtistsContext gets the most listened artists of a user, or of
+// everyone in guildID when userID is empty
+func (m *MemoryStore) GetTopArtistsContext(ctx context.Context, userID, guildID string, limit int) ([]TrackHours, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.topTracks(userID, guildID, limit, func(key trackKey) trackKey { return trackKey{artist: key.artist} }), nil
+}
+
+// GetTopTracksContext gets the most listened tracks of a user, or of
+// everyone in guildID when userID is empty
+func (m *MemoryStore) GetTopTracksContext(ctx context.Context, userID, guildID string, limit int) ([]TrackHours, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.topTracks(userID, guildID, limit, func(key trackKey) trackKey { return key }), nil
+}
+
+// topTracks sums listening time grouped by group. The caller must hold mu.
+func (m *MemoryStore) topTracks(userID, guildID string, limit int, group func(trackKey) trackKey) []TrackHours {
+	totals := make(map[trackKey]int64)
+	if userID != "" {
+		for key, seconds := range m.tracks[userID] {
+			totals[group(key)] += seconds
+		}
+	} else {
+		for userGuild, tracks := range m.guildTracks {
+			if userGuild.guildID != guildID {
+				continue
+			}
+			for key, seconds := range tracks {
+				totals[group(key)] += seconds
+			}
+		}
+	}
+
+	var tracks []TrackHours
+	for key, seconds := range totals {
+		tracks = append(tracks, TrackHours{Artist: key.artist, Track: key.track, TotalSeconds: seconds})
+	}
+	sort.Slice(tracks, func(i, j int) bool { return tracks[i].TotalSeconds > tracks[j].TotalSeconds })
+	if len(tracks) > limit {
+		tracks = tracks[:limit]
+	}
+	return tracks
+}
+
+// AddActivityDetailSecondsContext adds seconds spent in a rich presence detail of an activity
+func (m *MemoryStore) AddActivityDetailSecondsContext(ctx context.Context, userID, activityName, detail string, seconds int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.details[userID] == nil {
+		m.details[userID] = make(map[trackKey]int64)
+	}
+	m.details[userID][trackKey{activityName, detail}] += seconds
+	return nil
+}
+
+// GetActivityDetailHoursContext gets a user's time per rich presence detail of an activity
+func (m *MemoryStore) GetActivityDetailHoursContext(ctx context.Context, userID, activityName string, limit int) ([]ActivityDetailHours, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	totals := make(map[string]int64)
+	for key, seconds := range m.details[userID] {
+		if strings.EqualFold(key.artist, activityName) {
+			totals[key.track] += seconds
+		}
+	}
+
+	var details []ActivityDetailHours
+	for detail, seconds := range totals {
+		details = append(details, ActivityDetailHours{Detail: detail, TotalSeconds: seconds})
+	}
+	sort.Slice(details, func(i, j int) bool { return details[i].TotalSeconds > details[j].TotalSeconds })
+	if len(details) > limit {
+		details = details[:limit]
+	}
+	return details, nil
+}
+
+// GetDetailActivitiesContext gets the activities whose rich presence details are tracked in a guild
+func (m *MemoryStore) GetDetailActivitiesContext(ctx context.Context, guildID string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys []string
+	for key := range m.detailGames[guildID] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// AddDetailActivityContext starts tracking an activity's rich presence details in a guild
+func (m *MemoryStore) AddDetailActivityContext(ctx context.Context, guildID, activityKey string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.detailGames[guildID] == nil {
+		m.detailGames[guildID] = make(map[string]bool)
+	}
+	m.detailGames[guildID][activityKey] = true
+	return nil
+}
+
+// RemoveDetailActivityContext stops tracking an activity's rich presence details in a guild
+func (m *MemoryStore) RemoveDetailActivityContext(ctx context.Context, guildID, activityKey string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.detailGames[guildID], activityKey)
+	return nil
+}
@@ -0,0 +1,646 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// migration is a numbered schema change. Up statements must be safe to run
+// against databases created by older versions of the bot, which created the
+// tables directly. A migration with no Down statements is irreversible
+// data conversion and is only unrecorded when reverted.
+//
+// Up and Down are written for PostgreSQL. SQLiteUp and SQLiteDown replace
+// them on SQLite when set, and PostgresOnly migrations convert legacy data
+// that can't exist in a SQLite database.
+type migration struct {
+	Version      int
+	Name         string
+	Up           []string
+	Down         []string
+	SQLiteUp     []string
+	SQLiteDown   []string
+	PostgresOnly bool
+}
+
+// up returns the statements applying a migration in a dialect
+func (m migration) up(dialect string) []string {
+	if dialect == DialectSQLite {
+		if m.PostgresOnly {
+			return nil
+		}
+		if m.SQLiteUp != nil {
+			return m.SQLiteUp
+		}
+	}
+	return m.Up
+}
+
+// down returns the statements reverting a migration in a dialect
+func (m migration) down(dialect string) []string {
+	if dialect == DialectSQLite {
+		if m.PostgresOnly {
+			return nil
+		}
+		if m.SQLiteDown != nil {
+			return m.SQLiteDown
+		}
+	}
+	return m.Down
+}
+
+// MigrationStatus reports whether a migration has been applied
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// migrations lists every schema change in order. Never edit or renumber an
+// applied migration; add a new one instead.
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "create_base_tables",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS voice_hours (
+				user_id TEXT NOT NULL,
+				guild_id TEXT NOT NULL,
+				total_seconds BIGINT NOT NULL DEFAULT 0,
+				PRIMARY KEY (user_id, guild_id)
+			)`,
+			`CREATE TABLE IF NOT EXISTS activity_hours (
+				user_id TEXT NOT NULL,
+				activity_name TEXT NOT NULL,
+				total_seconds BIGINT NOT NULL DEFAULT 0,
+				PRIMARY KEY (user_id, activity_name)
+			)`,
+			`CREATE TABLE IF NOT EXISTS voice_channel_hours (
+				user_id TEXT NOT NULL,
+				guild_id TEXT NOT NULL,
+				channel_id TEXT NOT NULL,
+				total_seconds BIGINT NOT NULL DEFAULT 0,
+				PRIMARY KEY (user_id, guild_id, channel_id)
+			)`,
+			`CREATE TABLE IF NOT EXISTS daily_stats (
+				date DATE NOT NULL,
+				user_id TEXT NOT NULL,
+				guild_id TEXT NOT NULL,
+				voice_seconds BIGINT NOT NULL DEFAULT 0,
+				activity_seconds BIGINT NOT NULL DEFAULT 0,
+				activity_name TEXT DEFAULT '',
+				PRIMARY KEY (date, user_id, guild_id, activity_name)
+			)`,
+			`CREATE TABLE IF NOT EXISTS weekly_stats (
+				week_start DATE NOT NULL,
+				user_id TEXT NOT NULL,
+				guild_id TEXT NOT NULL,
+				voice_seconds BIGINT NOT NULL DEFAULT 0,
+				activity_seconds BIGINT NOT NULL DEFAULT 0,
+				activity_name TEXT DEFAULT '',
+				PRIMARY KEY (week_start, user_id, guild_id, activity_name)
+			)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS weekly_stats`,
+			`DROP TABLE IF EXISTS daily_stats`,
+			`DROP TABLE IF EXISTS voice_channel_hours`,
+			`DROP TABLE IF EXISTS activity_hours`,
+			`DROP TABLE IF EXISTS voice_hours`,
+		},
+	},
+	{
+		// Very old versions stored minutes, and 'guild:user' in user_id
+		Version:      2,
+		Name:         "convert_legacy_voice_hours",
+		PostgresOnly: true,
+		Up: []string{
+			`ALTER TABLE voice_hours ADD COLUMN IF NOT EXISTS total_seconds BIGINT NOT NULL DEFAULT 0`,
+			`DO $$
+			BEGIN
+				IF EXISTS (
+					SELECT 1 FROM information_schema.columns
+					WHERE table_name = 'voice_hours' AND column_name = 'total_minutes'
+				) THEN
+					UPDATE voice_hours SET total_seconds = total_minutes * 60 WHERE total_seconds = 0;
+					ALTER TABLE voice_hours DROP COLUMN total_minutes;
+				END IF;
+			END$$`,
+			`ALTER TABLE voice_hours ADD COLUMN IF NOT EXISTS guild_id TEXT`,
+			`UPDATE voice_hours SET guild_id = split_part(user_id, ':', 1) WHERE guild_id IS NULL AND position(':' in user_id) > 0`,
+			`UPDATE voice_hours SET user_id = split_part(user_id, ':', 2) WHERE position(':' in user_id) > 0`,
+			`UPDATE voice_hours SET guild_id = '' WHERE guild_id IS NULL`,
+			`ALTER TABLE voice_hours ALTER COLUMN user_id SET NOT NULL`,
+			`ALTER TABLE voice_hours ALTER COLUMN guild_id SET NOT NULL`,
+			// Ensure composite primary key (user_id, guild_id)
+			`DO $$
+			DECLARE
+				pk_name text;
+				pk_columns text;
+			BEGIN
+				SELECT c.conname, string_agg(a.attname, ',' ORDER BY a.attname) INTO pk_name, pk_columns
+				FROM pg_constraint c
+				JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = ANY (c.conkey)
+				WHERE c.contype = 'p' AND c.conrelid = 'voice_hours'::regclass
+				GROUP BY c.conname;
+
+				IF pk_columns IS DISTINCT FROM 'guild_id,user_id' THEN
+					IF pk_name IS NOT NULL THEN
+						EXECUTE format('ALTER TABLE voice_hours DROP CONSTRAINT %I', pk_name);
+					END IF;
+					ALTER TABLE voice_hours ADD CONSTRAINT voice_hours_pkey PRIMARY KEY (user_id, guild_id);
+				END IF;
+			END$$`,
+		},
+	},
+	{
+		// Old versions kept activity time per guild; it is now global per user
+		Version:      3,
+		Name:         "convert_legacy_activity_hours",
+		PostgresOnly: true,
+		Up: []string{
+			`DO $$
+			BEGIN
+				IF EXISTS (
+					SELECT 1 FROM information_schema.columns
+					WHERE table_name = 'activity_hours' AND column_name = 'guild_id'
+				) THEN
+					CREATE TABLE activity_hours_new (
+						user_id TEXT NOT NULL,
+						activity_name TEXT NOT NULL,
+						total_seconds BIGINT NOT NULL DEFAULT 0,
+						PRIMARY KEY (user_id, activity_name)
+					);
+					INSERT INTO activity_hours_new (user_id, activity_name, total_seconds)
+					SELECT user_id, activity_name, SUM(total_seconds)
+					FROM activity_hours
+					GROUP BY user_id, activity_name;
+					DROP TABLE activity_hours;
+					ALTER TABLE activity_hours_new RENAME TO activity_hours;
+				END IF;
+			END$$`,
+		},
+	},
+	{
+		Version: 4,
+		Name:    "create_open_sessions",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS open_sessions (
+				kind TEXT NOT NULL,
+				user_id TEXT NOT NULL,
+				guild_id TEXT NOT NULL DEFAULT '',
+				subject TEXT NOT NULL,
+				started_at TIMESTAMPTZ NOT NULL,
+				last_seen TIMESTAMPTZ NOT NULL,
+				PRIMARY KEY (kind, user_id, guild_id, subject)
+			)`,
+			`ALTER TABLE open_sessions ADD COLUMN IF NOT EXISTS credited_until TIMESTAMPTZ`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS open_sessions`,
+		},
+		SQLiteUp: []string{
+			`CREATE TABLE IF NOT EXISTS open_sessions (
+				kind TEXT NOT NULL,
+				user_id TEXT NOT NULL,
+				guild_id TEXT NOT NULL DEFAULT '',
+				subject TEXT NOT NULL,
+				started_at TIMESTAMP NOT NULL,
+				credited_until TIMESTAMP,
+				last_seen TIMESTAMP NOT NULL,
+				PRIMARY KEY (kind, user_id, guild_id, subject)
+			)`,
+		},
+	},
+	{
+		Version: 5,
+		Name:    "create_timezone_settings",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS guild_settings (
+				guild_id TEXT PRIMARY KEY,
+				timezone TEXT NOT NULL DEFAULT ''
+			)`,
+			`CREATE TABLE IF NOT EXISTS user_settings (
+				user_id TEXT PRIMARY KEY,
+				timezone TEXT NOT NULL DEFAULT ''
+			)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS user_settings`,
+			`DROP TABLE IF EXISTS guild_settings`,
+		},
+	},
+	{
+		Version: 6,
+		Name:    "create_idle_voice",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS ignored_channels (
+				guild_id TEXT NOT NULL,
+				channel_id TEXT NOT NULL,
+				PRIMARY KEY (guild_id, channel_id)
+			)`,
+			`CREATE TABLE IF NOT EXISTS voice_idle_hours (
+				user_id TEXT NOT NULL,
+				guild_id TEXT NOT NULL,
+				total_seconds BIGINT NOT NULL DEFAULT 0,
+				PRIMARY KEY (user_id, guild_id)
+			)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS voice_idle_hours`,
+			`DROP TABLE IF EXISTS ignored_channels`,
+		},
+	},
+	{
+		Version: 7,
+		Name:    "create_voice_state_hours",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS voice_state_hours (
+				user_id TEXT NOT NULL,
+				guild_id TEXT NOT NULL,
+				muted_seconds BIGINT NOT NULL DEFAULT 0,
+				deafened_seconds BIGINT NOT NULL DEFAULT 0,
+				streaming_seconds BIGINT NOT NULL DEFAULT 0,
+				video_seconds BIGINT NOT NULL DEFAULT 0,
+				PRIMARY KEY (user_id, guild_id)
+			)`,
+			`ALTER TABLE guild_settings ADD COLUMN IF NOT EXISTS exclude_deafened BOOLEAN NOT NULL DEFAULT FALSE`,
+		},
+		Down: []string{
+			`ALTER TABLE guild_settings DROP COLUMN IF EXISTS exclude_deafened`,
+			`DROP TABLE IF EXISTS voice_state_hours`,
+		},
+		SQLiteUp: []string{
+			`CREATE TABLE IF NOT EXISTS voice_state_hours (
+				user_id TEXT NOT NULL,
+				guild_id TEXT NOT NULL,
+				muted_seconds BIGINT NOT NULL DEFAULT 0,
+				deafened_seconds BIGINT NOT NULL DEFAULT 0,
+				streaming_seconds BIGINT NOT NULL DEFAULT 0,
+				video_seconds BIGINT NOT NULL DEFAULT 0,
+				PRIMARY KEY (user_id, guild_id)
+			)`,
+			`ALTER TABLE guild_settings ADD COLUMN exclude_deafened BOOLEAN NOT NULL DEFAULT FALSE`,
+		},
+		SQLiteDown: []string{
+			`ALTER TABLE guild_settings DROP COLUMN exclude_deafened`,
+			`DROP TABLE IF EXISTS voice_state_hours`,
+		},
+	},
+	{
+		Version: 8,
+		Name:    "add_guild_min_humans",
+		Up: []string{
+			`ALTER TABLE guild_settings ADD COLUMN IF NOT EXISTS min_humans INTEGER NOT NULL DEFAULT 1`,
+		},
+		Down: []string{
+			`ALTER TABLE guild_settings DROP COLUMN IF EXISTS min_humans`,
+		},
+		SQLiteUp: []string{
+			`ALTER TABLE guild_settings ADD COLUMN min_humans INTEGER NOT NULL DEFAULT 1`,
+		},
+		SQLiteDown: []string{
+			`ALTER TABLE guild_settings DROP COLUMN min_humans`,
+		},
+	},
+	{
+		Version: 9,
+		Name:    "create_sessions",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS sessions (
+				id BIGSERIAL PRIMARY KEY,
+				kind TEXT NOT NULL,
+				user_id TEXT NOT NULL,
+				guild_id TEXT NOT NULL,
+				subject TEXT NOT NULL,
+				started_at TIMESTAMPTZ NOT NULL,
+				ended_at TIMESTAMPTZ NOT NULL,
+				idle BOOLEAN NOT NULL DEFAULT FALSE,
+				muted BOOLEAN NOT NULL DEFAULT FALSE,
+				deafened BOOLEAN NOT NULL DEFAULT FALSE,
+				streaming BOOLEAN NOT NULL DEFAULT FALSE,
+				video BOOLEAN NOT NULL DEFAULT FALSE
+			)`,
+			`CREATE INDEX IF NOT EXISTS sessions_user_started_idx ON sessions (user_id, started_at)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS sessions`,
+		},
+		SQLiteUp: []string{
+			`CREATE TABLE IF NOT EXISTS sessions (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				kind TEXT NOT NULL,
+				user_id TEXT NOT NULL,
+				guild_id TEXT NOT NULL,
+				subject TEXT NOT NULL,
+				started_at TIMESTAMP NOT NULL,
+				ended_at TIMESTAMP NOT NULL,
+				idle BOOLEAN NOT NULL DEFAULT FALSE,
+				muted BOOLEAN NOT NULL DEFAULT FALSE,
+				deafened BOOLEAN NOT NULL DEFAULT FALSE,
+				streaming BOOLEAN NOT NULL DEFAULT FALSE,
+				video BOOLEAN NOT NULL DEFAULT FALSE
+			)`,
+			`CREATE INDEX IF NOT EXISTS sessions_user_started_idx ON sessions (user_id, started_at)`,
+		},
+	},
+	{
+		// Activity used to be credited to the guild whose presence update
+		// started it, so the weekly stats seed the per-guild totals
+		Version: 10,
+		Name:    "create_guild_activity_hours",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS guild_activity_hours (
+				user_id TEXT NOT NULL,
+				guild_id TEXT NOT NULL,
+				activity_name TEXT NOT NULL,
+				total_seconds BIGINT NOT NULL DEFAULT 0,
+				PRIMARY KEY (user_id, guild_id, activity_name)
+			)`,
+			`CREATE INDEX IF NOT EXISTS guild_activity_hours_activity_idx ON guild_activity_hours (guild_id, activity_name)`,
+			`INSERT INTO guild_activity_hours (user_id, guild_id, activity_name, total_seconds)
+				SELECT user_id, guild_id, activity_name, SUM(activity_seconds)
+				FROM weekly_stats
+				WHERE activity_name <> ''
+				GROUP BY user_id, guild_id, activity_name`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS guild_activity_hours`,
+		},
+	},
+	{
+		Version: 11,
+		Name:    "create_activity_aliases",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS activity_aliases (
+				guild_id TEXT NOT NULL,
+				alias TEXT NOT NULL,
+				activity_name TEXT NOT NULL,
+				PRIMARY KEY (guild_id, alias)
+			)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS activity_aliases`,
+		},
+	},
+	{
+		// Custom statuses and Spotify were recorded as plain activities
+		Version: 12,
+		Name:    "create_activity_types",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS activity_types (
+				activity_name TEXT PRIMARY KEY,
+				activity_type TEXT NOT NULL
+			)`,
+			`INSERT INTO activity_types (activity_name, activity_type)
+				VALUES ('Custom Status', 'custom'), ('Spotify', 'listening')`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS activity_types`,
+		},
+	},
+	{
+		Version: 13,
+		Name:    "create_listening_history",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS listening_sessions (
+				id BIGSERIAL PRIMARY KEY,
+				user_id TEXT NOT NULL,
+				track TEXT NOT NULL,
+				artist TEXT NOT NULL,
+				album TEXT NOT NULL,
+				started_at TIMESTAMPTZ NOT NULL,
+				ended_at TIMESTAMPTZ NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS listening_sessions_user_started_idx ON listening_sessions (user_id, started_at)`,
+			`CREATE TABLE IF NOT EXISTS track_hours (
+				user_id TEXT NOT NULL,
+				artist TEXT NOT NULL,
+				track TEXT NOT NULL,
+				total_seconds BIGINT NOT NULL DEFAULT 0,
+				PRIMARY KEY (user_id, artist, track)
+			)`,
+			`CREATE TABLE IF NOT EXISTS guild_track_hours (
+				user_id TEXT NOT NULL,
+				guild_id TEXT NOT NULL,
+				artist TEXT NOT NULL,
+				track TEXT NOT NULL,
+				total_seconds BIGINT NOT NULL DEFAULT 0,
+				PRIMARY KEY (user_id, guild_id, artist, track)
+			)`,
+			`CREATE INDEX IF NOT EXISTS guild_track_hours_guild_idx ON guild_track_hours (guild_id)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS guild_track_hours`,
+			`DROP TABLE IF EXISTS track_hours`,
+			`DROP TABLE IF EXISTS listening_sessions`,
+		},
+		SQLiteUp: []string{
+			`CREATE TABLE IF NOT EXISTS listening_sessions (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id TEXT NOT NULL,
+				track TEXT NOT NULL,
+				artist TEXT NOT NULL,
+				album TEXT NOT NULL,
+				started_at TIMESTAMP NOT NULL,
+				ended_at TIMESTAMP NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS listening_sessions_user_started_idx ON listening_sessions (user_id, started_at)`,
+			`CREATE TABLE IF NOT EXISTS track_hours (
+				user_id TEXT NOT NULL,
+				artist TEXT NOT NULL,
+				track TEXT NOT NULL,
+				total_seconds BIGINT NOT NULL DEFAULT 0,
+				PRIMARY KEY (user_id, artist, track)
+			)`,
+			`CREATE TABLE IF NOT EXISTS guild_track_hours (
+				user_id TEXT NOT NULL,
+				guild_id TEXT NOT NULL,
+				artist TEXT NOT NULL,
+				track TEXT NOT NULL,
+				total_seconds BIGINT NOT NULL DEFAULT 0,
+				PRIMARY KEY (user_id, guild_id, artist, track)
+			)`,
+			`CREATE INDEX IF NOT EXISTS guild_track_hours_guild_idx ON guild_track_hours (guild_id)`,
+		},
+	},
+	{
+		Version: 14,
+		Name:    "create_activity_details",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS detail_activities (
+				guild_id TEXT NOT NULL,
+				activity_key TEXT NOT NULL,
+				PRIMARY KEY (guild_id, activity_key)
+			)`,
+			`CREATE TABLE IF NOT EXISTS activity_detail_hours (
+				user_id TEXT NOT NULL,
+				activity_name TEXT NOT NULL,
+				detail TEXT NOT NULL,
+				total_seconds BIGINT NOT NULL DEFAULT 0,
+				PRIMARY KEY (user_id, activity_name, detail)
+			)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS activity_detail_hours`,
+			`DROP TABLE IF EXISTS detail_activities`,
+		},
+	},
+	{
+		Version: 15,
+		Name:    "add_open_session_run_and_end",
+		Up: []string{
+			`ALTER TABLE open_sessions ADD COLUMN IF NOT EXISTS run_id TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE open_sessions ADD COLUMN IF NOT EXISTS ended_at TIMESTAMPTZ`,
+		},
+		Down: []string{
+			`ALTER TABLE open_sessions DROP COLUMN IF EXISTS ended_at`,
+			`ALTER TABLE open_sessions DROP COLUMN IF EXISTS run_id`,
+		},
+		SQLiteUp: []string{
+			`ALTER TABLE open_sessions ADD COLUMN run_id TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE open_sessions ADD COLUMN ended_at TIMESTAMP`,
+		},
+		SQLiteDown: []string{
+			`ALTER TABLE open_sessions DROP COLUMN ended_at`,
+			`ALTER TABLE open_sessions DROP COLUMN run_id`,
+		},
+	},
+}
+
+// ensureMigrationsTable creates the table recording applied migrations
+func (db *DB) ensureMigrationsTable() error {
+	timestamp := "TIMESTAMPTZ"
+	if db.dialect == DialectSQLite {
+		timestamp = "TIMESTAMP"
+	}
+	_, err := db.conn.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at ` + timestamp + ` NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	return nil
+}
+
+// appliedMigrations gets the applied migration versions and when they ran
+func (db *DB) appliedMigrations() (map[int]time.Time, error) {
+	if err := db.ensureMigrationsTable(); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.conn.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan applied migration: %w", err)
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// MigrateUp applies every pending migration in order, each in its own
+// transaction, and stops at the first failure
+func (db *DB) MigrateUp() error {
+	applied, err := db.appliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if _, done := applied[m.Version]; done {
+			continue
+		}
+		err := db.inTransaction(m.up(db.dialect), func(tx *sql.Tx) error {
+			_, err := tx.Exec(db.rebind("INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)"),
+				m.Version, m.Name, time.Now().UTC())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to apply migration %d_%s: %w", m.Version, m.Name, err)
+		}
+		log.Printf("Applied migration %d_%s", m.Version, m.Name)
+	}
+	return nil
+}
+
+// MigrateDown reverts the last steps applied migrations, newest first
+func (db *DB) MigrateDown(steps int) error {
+	applied, err := db.appliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+		m := migrations[i]
+		if _, done := applied[m.Version]; !done {
+			continue
+		}
+		statements := m.down(db.dialect)
+		if len(statements) == 0 {
+			log.Printf("Migration %d_%s has no down statements; only its record is removed", m.Version, m.Name)
+		}
+		err := db.inTransaction(statements, func(tx *sql.Tx) error {
+			_, err := tx.Exec(db.rebind("DELETE FROM schema_migrations WHERE version = $1"), m.Version)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to revert migration %d_%s: %w", m.Version, m.Name, err)
+		}
+		log.Printf("Reverted migration %d_%s", m.Version, m.Name)
+		steps--
+	}
+	return nil
+}
+
+// MigrationStatus lists every known migration and whether it is applied
+func (db *DB) MigrationStatus() ([]MigrationStatus, error) {
+	applied, err := db.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		appliedAt, done := applied[m.Version]
+		statuses = append(statuses, MigrationStatus{
+			Version:   m.Version,
+			Name:      m.Name,
+			Applied:   done,
+			AppliedAt: appliedAt,
+		})
+	}
+	return statuses, nil
+}
+
+// inTransaction runs statements followed by record in a single transaction
+func (db *DB) inTransaction(statements []string, record func(*sql.Tx) error) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	if err := record(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,282 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"playstats/pkg/utils"
+)
+
+// RebuildResult summarizes a rebuild of the aggregate tables
+type RebuildResult struct {
+	Sessions        int
+	VoiceSeconds    int64
+	IdleSeconds     int64
+	ActivitySeconds int64
+}
+
+// rebuildTables are the aggregate tables recomputed from the session log
+var rebuildTables = []string{
+	"voice_hours",
+	"voice_idle_hours",
+	"voice_state_hours",
+	"voice_channel_hours",
+	"activity_hours",
+	"guild_activity_hours",
+	"daily_stats",
+	"weekly_stats",
+}
+
+// periodKey identifies a daily or weekly stats row
+type periodKey struct {
+	period, userID, guildID, activityName string
+}
+
+// unionSeconds counts the seconds covered by any of the spans, so activity
+// logged in several guilds at once is only counted once
+func unionSeconds(spans []utils.Span) int64 {
+	sort.Slice(spans, func(i, j int) bool { return spans[i].Start.Before(spans[j].Start) })
+
+	var seconds int64
+	var current utils.Span
+	for i, span := range spans {
+		if i > 0 && !span.Start.After(current.End) {
+			if span.End.After(current.End) {
+				current.End = span.End
+			}
+			continue
+		}
+		if i > 0 {
+			seconds += current.Seconds()
+		}
+		current = span
+	}
+	if len(spans) > 0 {
+		seconds += current.Seconds()
+	}
+	return seconds
+}
+
+// RebuildAggregates recomputes every aggregate table from the raw session
+// log in a single transaction. location resolves the timezone used for a
+// user's daily and weekly stats in a guild; it runs while the transaction
+// holds the connection, so it must not query the database. Guild totals
+// and stats use the guild's activity aliases, like the bot. Totals
+// recorded before the session log existed are discarded. Increments still
+// in a BufferedStore spill file are not part of the log and would be
+// counted again when replayed, so the file must be flushed or removed
+// first.
+func (r *Repository) RebuildAggregates(location func(guildID, userID string) *time.Location) (RebuildResult, error) {
+	var result RebuildResult
+
+	aliases, err := r.allActivityAliases(context.Background())
+	if err != nil {
+		return result, err
+	}
+
+	tx, err := r.db.conn.Begin()
+	if err != nil {
+		return result, fmt.Errorf("failed to begin rebuild: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(r.db.rebind(`
+		SELECT kind, user_id, guild_id, subject, started_at, ended_at, idle, muted, deafened, streaming, video
+		FROM sessions`))
+	if err != nil {
+		return result, fmt.Errorf("failed to get session logs: %w", err)
+	}
+
+	voice := make(map[[2]string]int64)
+	idle := make(map[[2]string]int64)
+	states := make(map[[2]string]*VoiceStateHours)
+	channels := make(map[[3]string]int64)
+	activities := make(map[[2]string][]utils.Span)
+	guildActivities := make(map[[3]string]int64)
+	daily := make(map[periodKey][2]int64)
+	weekly := make(map[periodKey][2]int64)
+
+	for rows.Next() {
+		var entry SessionLog
+		if err := rows.Scan(&entry.Kind, &entry.UserID, &entry.GuildID, &entry.Subject,
+			&entry.StartedAt, &entry.EndedAt, &entry.Idle, &entry.Muted, &entry.Deafened,
+			&entry.Streaming, &entry.Video); err != nil {
+			rows.Close()
+			return result, fmt.Errorf("failed to scan session log: %w", err)
+		}
+		result.Sessions++
+
+		seconds := int64(entry.EndedAt.Sub(entry.StartedAt) / time.Second)
+		if seconds <= 0 {
+			continue
+		}
+		userGuild := [2]string{entry.UserID, entry.GuildID}
+
+		activityName := ""
+		switch {
+		case entry.Kind == SessionKindActivity:
+			key := [2]string{entry.UserID, entry.Subject}
+			activities[key] = append(activities[key], utils.Span{Start: entry.StartedAt, End: entry.EndedAt})
+
+			activityName = entry.Subject
+			if alias, exists := aliases[entry.GuildID][utils.ActivityKey(entry.Subject)]; exists {
+				activityName = alias
+			}
+			guildActivities[[3]string{entry.UserID, entry.GuildID, activityName}] += seconds
+
+		case entry.Idle:
+			idle[userGuild] += seconds
+			result.IdleSeconds += seconds
+			continue
+
+		default:
+			voice[userGuild] += seconds
+			channels[[3]string{entry.UserID, entry.GuildID, entry.Subject}] += seconds
+			result.VoiceSeconds += seconds
+
+			if entry.Muted || entry.Deafened || entry.Streaming || entry.Video {
+				state := states[userGuild]
+				if state == nil {
+					state = &VoiceStateHours{UserID: entry.UserID, GuildID: entry.GuildID}
+					states[userGuild] = state
+				}
+				if entry.Muted {
+					state.MutedSeconds += seconds
+				}
+				if entry.Deafened {
+					state.DeafenedSeconds += seconds
+				}
+				if entry.Streaming {
+					state.StreamingSeconds += seconds
+				}
+				if entry.Video {
+					state.VideoSeconds += seconds
+				}
+			}
+		}
+
+		// Split into daily and weekly buckets the same way the bot does
+		loc := location(entry.GuildID, entry.UserID)
+		for _, span := range utils.SplitByDay(entry.StartedAt, entry.EndedAt, loc) {
+			spanSeconds := span.Seconds()
+			if spanSeconds <= 0 {
+				continue
+			}
+			index := 0
+			if activityName != "" {
+				index = 1
+			}
+
+			day := periodKey{utils.FormatDate(span.Start, loc), entry.UserID, entry.GuildID, activityName}
+			totals := daily[day]
+			totals[index] += spanSeconds
+			daily[day] = totals
+
+			week := periodKey{utils.FormatDate(utils.WeekStart(span.Start, loc), loc), entry.UserID, entry.GuildID, activityName}
+			totals = weekly[week]
+			totals[index] += spanSeconds
+			weekly[week] = totals
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, fmt.Errorf("failed to read session logs: %w", err)
+	}
+
+	for _, table := range rebuildTables {
+		if _, err := tx.Exec("DELETE FROM " + table); err != nil {
+			return result, fmt.Errorf("failed to clear %s: %w", table, err)
+		}
+	}
+
+	for key, seconds := range voice {
+		if _, err := tx.Exec(r.db.rebind("INSERT INTO voice_hours (user_id, guild_id, total_seconds) VALUES ($1, $2, $3)"),
+			key[0], key[1], seconds); err != nil {
+			return result, fmt.Errorf("failed to rebuild voice hours: %w", err)
+		}
+	}
+	for key, seconds := range idle {
+		if _, err := tx.Exec(r.db.rebind("INSERT INTO voice_idle_hours (user_id, guild_id, total_seconds) VALUES ($1, $2, $3)"),
+			key[0], key[1], seconds); err != nil {
+			return result, fmt.Errorf("failed to rebuild idle hours: %w", err)
+		}
+	}
+	for _, state := range states {
+		if _, err := tx.Exec(r.db.rebind(`
+			INSERT INTO voice_state_hours (user_id, guild_id, muted_seconds, deafened_seconds, streaming_seconds, video_seconds)
+			VALUES ($1, $2, $3, $4, $5, $6)`),
+			state.UserID, state.GuildID, state.MutedSeconds, state.DeafenedSeconds,
+			state.StreamingSeconds, state.VideoSeconds); err != nil {
+			return result, fmt.Errorf("failed to rebuild voice state hours: %w", err)
+		}
+	}
+	for key, seconds := range channels {
+		if _, err := tx.Exec(r.db.rebind("INSERT INTO voice_channel_hours (user_id, guild_id, channel_id, total_seconds) VALUES ($1, $2, $3, $4)"),
+			key[0], key[1], key[2], seconds); err != nil {
+			return result, fmt.Errorf("failed to rebuild channel hours: %w", err)
+		}
+	}
+	for key, spans := range activities {
+		seconds := unionSeconds(spans)
+		result.ActivitySeconds += seconds
+		if _, err := tx.Exec(r.db.rebind("INSERT INTO activity_hours (user_id, activity_name, total_seconds) VALUES ($1, $2, $3)"),
+			key[0], key[1], seconds); err != nil {
+			return result, fmt.Errorf("failed to rebuild activity hours: %w", err)
+		}
+	}
+	for key, seconds := range guildActivities {
+		if _, err := tx.Exec(r.db.rebind("INSERT INTO guild_activity_hours (user_id, guild_id, activity_name, total_seconds) VALUES ($1, $2, $3, $4)"),
+			key[0], key[1], key[2], seconds); err != nil {
+			return result, fmt.Errorf("failed to rebuild guild activity hours: %w", err)
+		}
+	}
+	for key, totals := range daily {
+		if _, err := tx.Exec(r.db.rebind(`
+			INSERT INTO daily_stats (date, user_id, guild_id, voice_seconds, activity_seconds, activity_name)
+			VALUES ($1, $2, $3, $4, $5, $6)`),
+			key.period, key.userID, key.guildID, totals[0], totals[1], key.activityName); err != nil {
+			return result, fmt.Errorf("failed to rebuild daily stats: %w", err)
+		}
+	}
+	for key, totals := range weekly {
+		if _, err := tx.Exec(r.db.rebind(`
+			INSERT INTO weekly_stats (week_start, user_id, guild_id, voice_seconds, activity_seconds, activity_name)
+			VALUES ($1, $2, $3, $4, $5, $6)`),
+			key.period, key.userID, key.guildID, totals[0], totals[1], key.activityName); err != nil {
+			return result, fmt.Errorf("failed to rebuild weekly stats: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return result, fmt.Errorf("failed to commit rebuild: %w", err)
+	}
+	return result, nil
+}
+
+// allActivityAliases loads the activity aliases of every guild, keyed by
+// guild ID and alias
+func (r *Repository) allActivityAliases(ctx context.Context) (map[string]map[string]string, error) {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := r.db.query(ctx, "SELECT guild_id, alias, activity_name FROM activity_aliases")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get activity aliases: %w", err)
+	}
+	defer rows.Close()
+
+	aliases := make(map[string]map[string]string)
+	for rows.Next() {
+		var guildID, alias, activityName string
+		if err := rows.Scan(&guildID, &alias, &activityName); err != nil {
+			return nil, fmt.Errorf("failed to scan activity alias: %w", err)
+		}
+		if aliases[guildID] == nil {
+			aliases[guildID] = make(map[string]string)
+		}
+		aliases[guildID][alias] = activityName
+	}
+	return aliases, rows.Err()
+}
@@ -1,12 +1,16 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
+	"time"
 )
 
-// Repository handles database operations
+// Repository handles database operations. Every call is bounded by the
+// database's query timeout; the Context variants are also cancelled with
+// their context.
 type Repository struct {
 	db *DB
 }
@@ -18,7 +22,15 @@ func NewRepository(db *DB) *Repository {
 
 // AddVoiceSeconds adds voice seconds to the database
 func (r *Repository) AddVoiceSeconds(userID, guildID string, seconds int64) error {
-	_, err := r.db.conn.Exec(`
+	return r.AddVoiceSecondsContext(context.Background(), userID, guildID, seconds)
+}
+
+// AddVoiceSecondsContext is like AddVoiceSeconds but takes a context
+func (r *Repository) AddVoiceSecondsContext(ctx context.Context, userID, guildID string, seconds int64) error {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := r.db.exec(ctx, `
 		INSERT INTO voice_hours (user_id, guild_id, total_seconds)
 		VALUES ($1, $2, $3)
 		ON CONFLICT (user_id, guild_id) DO UPDATE SET total_seconds = voice_hours.total_seconds + EXCLUDED.total_seconds`,
@@ -31,7 +43,15 @@ func (r *Repository) AddVoiceSeconds(userID, guildID string, seconds int64) erro
 
 // AddActivitySeconds adds activity seconds to the database
 func (r *Repository) AddActivitySeconds(userID, activityName string, seconds int64) error {
-	_, err := r.db.conn.Exec(`
+	return r.AddActivitySecondsContext(context.Background(), userID, activityName, seconds)
+}
+
+// AddActivitySecondsContext is like AddActivitySeconds but takes a context
+func (r *Repository) AddActivitySecondsContext(ctx context.Context, userID, activityName string, seconds int64) error {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := r.db.exec(ctx, `
 		INSERT INTO activity_hours (user_id, activity_name, total_seconds)
 		VALUES ($1, $2, $3)
 		ON CONFLICT (user_id, activity_name) DO UPDATE SET total_seconds = activity_hours.total_seconds + EXCLUDED.total_seconds`,
@@ -42,9 +62,38 @@ func (r *Repository) AddActivitySeconds(userID, activityName string, seconds int
 	return nil
 }
 
+// AddGuildActivitySeconds adds activity seconds for a user in a guild
+func (r *Repository) AddGuildActivitySeconds(userID, guildID, activityName string, seconds int64) error {
+	return r.AddGuildActivitySecondsContext(context.Background(), userID, guildID, activityName, seconds)
+}
+
+// AddGuildActivitySecondsContext is like AddGuildActivitySeconds but takes a context
+func (r *Repository) AddGuildActivitySecondsContext(ctx context.Context, userID, guildID, activityName string, seconds int64) error {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := r.db.exec(ctx, `
+		INSERT INTO guild_activity_hours (user_id, guild_id, activity_name, total_seconds)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, guild_id, activity_name) DO UPDATE SET total_seconds = guild_activity_hours.total_seconds + EXCLUDED.total_seconds`,
+		userID, guildID, activityName, seconds)
+	if err != nil {
+		return fmt.Errorf("failed to add guild activity seconds: %w", err)
+	}
+	return nil
+}
+
 // AddChannelSeconds adds voice channel seconds to the database
 func (r *Repository) AddChannelSeconds(userID, guildID, channelID string, seconds int64) error {
-	_, err := r.db.conn.Exec(`
+	return r.AddChannelSecondsContext(context.Background(), userID, guildID, channelID, seconds)
+}
+
+// AddChannelSecondsContext is like AddChannelSeconds but takes a context
+func (r *Repository) AddChannelSecondsContext(ctx context.Context, userID, guildID, channelID string, seconds int64) error {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := r.db.exec(ctx, `
 		INSERT INTO voice_channel_hours (user_id, guild_id, channel_id, total_seconds)
 		VALUES ($1, $2, $3, $4)
 		ON CONFLICT (user_id, guild_id, channel_id) DO UPDATE SET total_seconds = voice_channel_hours.total_seconds + EXCLUDED.total_seconds`,
@@ -55,10 +104,65 @@ func (r *Repository) AddChannelSeconds(userID, guildID, channelID string, second
 	return nil
 }
 
+// AddIdleSeconds adds voice seconds spent in AFK or ignored channels
+func (r *Repository) AddIdleSeconds(userID, guildID string, seconds int64) error {
+	return r.AddIdleSecondsContext(context.Background(), userID, guildID, seconds)
+}
+
+// AddIdleSecondsContext is like AddIdleSeconds but takes a context
+func (r *Repository) AddIdleSecondsContext(ctx context.Context, userID, guildID string, seconds int64) error {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := r.db.exec(ctx, `
+		INSERT INTO voice_idle_hours (user_id, guild_id, total_seconds)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, guild_id) DO UPDATE SET total_seconds = voice_idle_hours.total_seconds + EXCLUDED.total_seconds`,
+		userID, guildID, seconds)
+	if err != nil {
+		return fmt.Errorf("failed to add idle seconds: %w", err)
+	}
+	return nil
+}
+
+// AddVoiceStateSeconds adds muted, deafened, go-live and camera seconds
+func (r *Repository) AddVoiceStateSeconds(userID, guildID string, muted, deafened, streaming, video int64) error {
+	return r.AddVoiceStateSecondsContext(context.Background(), userID, guildID, muted, deafened, streaming, video)
+}
+
+// AddVoiceStateSecondsContext is like AddVoiceStateSeconds but takes a context
+func (r *Repository) AddVoiceStateSecondsContext(ctx context.Context, userID, guildID string, muted, deafened, streaming, video int64) error {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := r.db.exec(ctx, `
+		INSERT INTO voice_state_hours (user_id, guild_id, muted_seconds, deafened_seconds, streaming_seconds, video_seconds)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (user_id, guild_id)
+		DO UPDATE SET
+			muted_seconds = voice_state_hours.muted_seconds + EXCLUDED.muted_seconds,
+			deafened_seconds = voice_state_hours.deafened_seconds + EXCLUDED.deafened_seconds,
+			streaming_seconds = voice_state_hours.streaming_seconds + EXCLUDED.streaming_seconds,
+			video_seconds = voice_state_hours.video_seconds + EXCLUDED.video_seconds`,
+		userID, guildID, muted, deafened, streaming, video)
+	if err != nil {
+		return fmt.Errorf("failed to add voice state seconds: %w", err)
+	}
+	return nil
+}
+
 // GetVoiceHours gets total voice hours for a user in a guild
 func (r *Repository) GetVoiceHours(userID, guildID string) (int64, error) {
+	return r.GetVoiceHoursContext(context.Background(), userID, guildID)
+}
+
+// GetVoiceHoursContext is like GetVoiceHours but takes a context
+func (r *Repository) GetVoiceHoursContext(ctx context.Context, userID, guildID string) (int64, error) {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
 	var totalSeconds int64
-	err := r.db.conn.QueryRow(
+	err := r.db.queryRow(ctx,
 		"SELECT total_seconds FROM voice_hours WHERE user_id = $1 AND guild_id = $2",
 		userID, guildID).Scan(&totalSeconds)
 	if err != nil && err != sql.ErrNoRows {
@@ -67,11 +171,61 @@ func (r *Repository) GetVoiceHours(userID, guildID string) (int64, error) {
 	return totalSeconds, nil
 }
 
+// GetIdleHours gets total voice seconds in AFK or ignored channels for a user in a guild
+func (r *Repository) GetIdleHours(userID, guildID string) (int64, error) {
+	return r.GetIdleHoursContext(context.Background(), userID, guildID)
+}
+
+// GetIdleHoursContext is like GetIdleHours but takes a context
+func (r *Repository) GetIdleHoursContext(ctx context.Context, userID, guildID string) (int64, error) {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	var totalSeconds int64
+	err := r.db.queryRow(ctx,
+		"SELECT total_seconds FROM voice_idle_hours WHERE user_id = $1 AND guild_id = $2",
+		userID, guildID).Scan(&totalSeconds)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to get idle hours: %w", err)
+	}
+	return totalSeconds, nil
+}
+
+// GetVoiceStateHours gets the muted, deafened, go-live and camera breakdown for a user in a guild
+func (r *Repository) GetVoiceStateHours(userID, guildID string) (VoiceStateHours, error) {
+	return r.GetVoiceStateHoursContext(context.Background(), userID, guildID)
+}
+
+// GetVoiceStateHoursContext is like GetVoiceStateHours but takes a context
+func (r *Repository) GetVoiceStateHoursContext(ctx context.Context, userID, guildID string) (VoiceStateHours, error) {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	stats := VoiceStateHours{UserID: userID, GuildID: guildID}
+	err := r.db.queryRow(ctx, `
+		SELECT muted_seconds, deafened_seconds, streaming_seconds, video_seconds
+		FROM voice_state_hours WHERE user_id = $1 AND guild_id = $2`,
+		userID, guildID).Scan(&stats.MutedSeconds, &stats.DeafenedSeconds, &stats.StreamingSeconds, &stats.VideoSeconds)
+	if err != nil && err != sql.ErrNoRows {
+		return stats, fmt.Errorf("failed to get voice state hours: %w", err)
+	}
+	return stats, nil
+}
+
 // GetActivityHours gets total activity hours for a user and activity
 func (r *Repository) GetActivityHours(userID, activityName string) (int64, error) {
+	return r.GetActivityHoursContext(context.Background(), userID, activityName)
+}
+
+// GetActivityHoursContext is like GetActivityHours but takes a context
+func (r *Repository) GetActivityHoursContext(ctx context.Context, userID, activityName string) (int64, error) {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	// Names differing only in case are the same activity
 	var totalSeconds int64
-	err := r.db.conn.QueryRow(
-		"SELECT total_seconds FROM activity_hours WHERE user_id = $1 AND activity_name = $2",
+	err := r.db.queryRow(ctx,
+		"SELECT COALESCE(SUM(total_seconds), 0) FROM activity_hours WHERE user_id = $1 AND LOWER(activity_name) = LOWER($2)",
 		userID, activityName).Scan(&totalSeconds)
 	if err != nil && err != sql.ErrNoRows {
 		return 0, fmt.Errorf("failed to get activity hours: %w", err)
@@ -81,8 +235,22 @@ func (r *Repository) GetActivityHours(userID, activityName string) (int64, error
 
 // GetTopActivities gets top activities for a user
 func (r *Repository) GetTopActivities(userID string, limit int) ([]ActivityHours, error) {
-	rows, err := r.db.conn.Query(
-		"SELECT activity_name, total_seconds FROM activity_hours WHERE user_id = $1 ORDER BY total_seconds DESC LIMIT $2",
+	return r.GetTopActivitiesContext(context.Background(), userID, limit)
+}
+
+// GetTopActivitiesContext is like GetTopActivities but takes a context
+func (r *Repository) GetTopActivitiesContext(ctx context.Context, userID string, limit int) ([]ActivityHours, error) {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	// Names differing only in case are the same activity
+	rows, err := r.db.query(ctx, `
+		SELECT MIN(activity_name), SUM(total_seconds) AS seconds
+		FROM activity_hours
+		WHERE user_id = $1
+		GROUP BY LOWER(activity_name)
+		ORDER BY seconds DESC
+		LIMIT $2`,
 		userID, limit)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get top activities: %w", err)
@@ -103,9 +271,82 @@ func (r *Repository) GetTopActivities(userID string, limit int) ([]ActivityHours
 	return activities, nil
 }
 
+// GetActivityTypeHours gets a user's total activity time per activity type.
+// Activities without a recorded type count as playing.
+func (r *Repository) GetActivityTypeHours(userID string) ([]ActivityTypeHours, error) {
+	return r.GetActivityTypeHoursContext(context.Background(), userID)
+}
+
+// GetActivityTypeHoursContext is like GetActivityTypeHours but takes a context
+func (r *Repository) GetActivityTypeHoursContext(ctx context.Context, userID string) ([]ActivityTypeHours, error) {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	// Names differing only in case are the same activity, so types are
+	// matched case-insensitively, one type per name
+	rows, err := r.db.query(ctx, `
+		SELECT COALESCE(t.activity_type, $2), SUM(a.total_seconds) AS seconds
+		FROM activity_hours a
+		LEFT JOIN (
+			SELECT LOWER(activity_name) AS name_key, MAX(activity_type) AS activity_type
+			FROM activity_types
+			GROUP BY LOWER(activity_name)
+		) t ON t.name_key = LOWER(a.activity_name)
+		WHERE a.user_id = $1
+		GROUP BY 1
+		ORDER BY seconds DESC`,
+		userID, ActivityTypePlaying)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get activity type hours: %w", err)
+	}
+	defer rows.Close()
+
+	var types []ActivityTypeHours
+	for rows.Next() {
+		var hours ActivityTypeHours
+		if err := rows.Scan(&hours.ActivityType, &hours.TotalSeconds); err != nil {
+			log.Printf("Error scanning activity type row: %v", err)
+			continue
+		}
+		types = append(types, hours)
+	}
+
+	return types, nil
+}
+
+// SaveActivityType records the type of an activity, replacing the type it
+// was last seen with
+func (r *Repository) SaveActivityType(activityName, activityType string) error {
+	return r.SaveActivityTypeContext(context.Background(), activityName, activityType)
+}
+
+// SaveActivityTypeContext is like SaveActivityType but takes a context
+func (r *Repository) SaveActivityTypeContext(ctx context.Context, activityName, activityType string) error {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := r.db.exec(ctx, `
+		INSERT INTO activity_types (activity_name, activity_type)
+		VALUES ($1, $2)
+		ON CONFLICT (activity_name) DO UPDATE SET activity_type = EXCLUDED.activity_type`,
+		activityName, activityType)
+	if err != nil {
+		return fmt.Errorf("failed to save activity type: %w", err)
+	}
+	return nil
+}
+
 // GetVoiceChannelHours gets voice hours per channel for a user in a guild
 func (r *Repository) GetVoiceChannelHours(userID, guildID string) ([]VoiceChannelHours, error) {
-	rows, err := r.db.conn.Query(
+	return r.GetVoiceChannelHoursContext(context.Background(), userID, guildID)
+}
+
+// GetVoiceChannelHoursContext is like GetVoiceChannelHours but takes a context
+func (r *Repository) GetVoiceChannelHoursContext(ctx context.Context, userID, guildID string) ([]VoiceChannelHours, error) {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := r.db.query(ctx,
 		"SELECT channel_id, total_seconds FROM voice_channel_hours WHERE user_id = $1 AND guild_id = $2 ORDER BY total_seconds DESC",
 		userID, guildID)
 	if err != nil {
@@ -130,7 +371,15 @@ func (r *Repository) GetVoiceChannelHours(userID, guildID string) ([]VoiceChanne
 
 // AddDailyStats adds daily statistics
 func (r *Repository) AddDailyStats(date, userID, guildID string, voiceSeconds, activitySeconds int64, activityName string) error {
-	_, err := r.db.conn.Exec(`
+	return r.AddDailyStatsContext(context.Background(), date, userID, guildID, voiceSeconds, activitySeconds, activityName)
+}
+
+// AddDailyStatsContext is like AddDailyStats but takes a context
+func (r *Repository) AddDailyStatsContext(ctx context.Context, date, userID, guildID string, voiceSeconds, activitySeconds int64, activityName string) error {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := r.db.exec(ctx, `
 		INSERT INTO daily_stats (date, user_id, guild_id, voice_seconds, activity_seconds, activity_name)
 		VALUES ($1, $2, $3, $4, $5, $6)
 		ON CONFLICT (date, user_id, guild_id, activity_name) 
@@ -146,7 +395,15 @@ func (r *Repository) AddDailyStats(date, userID, guildID string, voiceSeconds, a
 
 // AddWeeklyStats adds weekly statistics
 func (r *Repository) AddWeeklyStats(weekStart, userID, guildID string, voiceSeconds, activitySeconds int64, activityName string) error {
-	_, err := r.db.conn.Exec(`
+	return r.AddWeeklyStatsContext(context.Background(), weekStart, userID, guildID, voiceSeconds, activitySeconds, activityName)
+}
+
+// AddWeeklyStatsContext is like AddWeeklyStats but takes a context
+func (r *Repository) AddWeeklyStatsContext(ctx context.Context, weekStart, userID, guildID string, voiceSeconds, activitySeconds int64, activityName string) error {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := r.db.exec(ctx, `
 		INSERT INTO weekly_stats (week_start, user_id, guild_id, voice_seconds, activity_seconds, activity_name)
 		VALUES ($1, $2, $3, $4, $5, $6)
 		ON CONFLICT (week_start, user_id, guild_id, activity_name) 
@@ -160,15 +417,25 @@ func (r *Repository) AddWeeklyStats(weekStart, userID, guildID string, voiceSeco
 	return nil
 }
 
-// GetVoiceLeaderboard gets voice leaderboard for a guild
-func (r *Repository) GetVoiceLeaderboard(guildID string, limit int) ([]LeaderboardEntry, error) {
-	rows, err := r.db.conn.Query(`
-		SELECT user_id, total_seconds 
-		FROM voice_hours 
-		WHERE guild_id = $1 
-		ORDER BY total_seconds DESC 
+// GetVoiceLeaderboard gets voice leaderboard for a guild, optionally
+// leaving out time spent deafened
+func (r *Repository) GetVoiceLeaderboard(guildID string, limit int, excludeDeafened bool) ([]LeaderboardEntry, error) {
+	return r.GetVoiceLeaderboardContext(context.Background(), guildID, limit, excludeDeafened)
+}
+
+// GetVoiceLeaderboardContext is like GetVoiceLeaderboard but takes a context
+func (r *Repository) GetVoiceLeaderboardContext(ctx context.Context, guildID string, limit int, excludeDeafened bool) ([]LeaderboardEntry, error) {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := r.db.query(ctx, `
+		SELECT v.user_id, v.total_seconds - CASE WHEN $3 THEN COALESCE(s.deafened_seconds, 0) ELSE 0 END AS seconds
+		FROM voice_hours v
+		LEFT JOIN voice_state_hours s ON s.user_id = v.user_id AND s.guild_id = v.guild_id
+		WHERE v.guild_id = $1 
+		ORDER BY seconds DESC 
 		LIMIT $2`,
-		guildID, limit)
+		guildID, limit, excludeDeafened)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get voice leaderboard: %w", err)
 	}
@@ -191,14 +458,38 @@ func (r *Repository) GetVoiceLeaderboard(guildID string, limit int) ([]Leaderboa
 }
 
 // GetActivityLeaderboard gets activity leaderboard for a specific activity
-func (r *Repository) GetActivityLeaderboard(activityName string, limit int) ([]LeaderboardEntry, error) {
-	rows, err := r.db.conn.Query(`
-		SELECT user_id, total_seconds 
-		FROM activity_hours 
-		WHERE activity_name = $1 
-		ORDER BY total_seconds DESC 
-		LIMIT $2`,
-		activityName, limit)
+// in a guild, or across all guilds when guildID is empty
+func (r *Repository) GetActivityLeaderboard(guildID, activityName string, limit int) ([]LeaderboardEntry, error) {
+	return r.GetActivityLeaderboardContext(context.Background(), guildID, activityName, limit)
+}
+
+// GetActivityLeaderboardContext is like GetActivityLeaderboard but takes a context
+func (r *Repository) GetActivityLeaderboardContext(ctx context.Context, guildID, activityName string, limit int) ([]LeaderboardEntry, error) {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	// Names differing only in case are the same activity
+	var rows *sql.Rows
+	var err error
+	if guildID == "" {
+		rows, err = r.db.query(ctx, `
+			SELECT user_id, SUM(total_seconds) AS seconds
+			FROM activity_hours 
+			WHERE LOWER(activity_name) = LOWER($1)
+			GROUP BY user_id
+			ORDER BY seconds DESC 
+			LIMIT $2`,
+			activityName, limit)
+	} else {
+		rows, err = r.db.query(ctx, `
+			SELECT user_id, SUM(total_seconds) AS seconds
+			FROM guild_activity_hours
+			WHERE guild_id = $1 AND LOWER(activity_name) = LOWER($2)
+			GROUP BY user_id
+			ORDER BY seconds DESC
+			LIMIT $3`,
+			guildID, activityName, limit)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get activity leaderboard: %w", err)
 	}
@@ -222,44 +513,60 @@ func (r *Repository) GetActivityLeaderboard(activityName string, limit int) ([]L
 
 // GetUserComparison gets comparison data for two users
 func (r *Repository) GetUserComparison(userID1, userID2, guildID string) ([]UserComparison, error) {
+	return r.GetUserComparisonContext(context.Background(), userID1, userID2, guildID)
+}
+
+// GetUserComparisonContext is like GetUserComparison but takes a context
+func (r *Repository) GetUserComparisonContext(ctx context.Context, userID1, userID2, guildID string) ([]UserComparison, error) {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
 	var comparisons []UserComparison
-	
+
 	// Get data for both users
 	userIDs := []string{userID1, userID2}
 	for _, userID := range userIDs {
 		comparison := UserComparison{UserID: userID}
-		
+
 		// Get voice hours for this guild
-		voiceSeconds, err := r.GetVoiceHours(userID, guildID)
+		voiceSeconds, err := r.GetVoiceHoursContext(ctx, userID, guildID)
 		if err != nil {
 			log.Printf("Error getting voice hours for user %s: %v", userID, err)
 		}
 		comparison.VoiceSeconds = voiceSeconds
-		
+
 		// Get top activities
-		activities, err := r.GetTopActivities(userID, 3)
+		activities, err := r.GetTopActivitiesContext(ctx, userID, 3)
 		if err != nil {
 			log.Printf("Error getting top activities for user %s: %v", userID, err)
 		}
 		comparison.TopActivities = activities
-		
+
 		// Get channel hours
-		channelHours, err := r.GetVoiceChannelHours(userID, guildID)
+		channelHours, err := r.GetVoiceChannelHoursContext(ctx, userID, guildID)
 		if err != nil {
 			log.Printf("Error getting channel hours for user %s: %v", userID, err)
 		}
 		comparison.ChannelHours = channelHours
-		
+
 		comparisons = append(comparisons, comparison)
 	}
-	
+
 	return comparisons, nil
 }
 
 // GetWeeklyReport gets weekly report for a user
 func (r *Repository) GetWeeklyReport(userID, guildID string, weekStart string) ([]WeeklyStats, error) {
-	rows, err := r.db.conn.Query(`
-		SELECT week_start, user_id, guild_id, voice_seconds, activity_seconds, activity_name
+	return r.GetWeeklyReportContext(context.Background(), userID, guildID, weekStart)
+}
+
+// GetWeeklyReportContext is like GetWeeklyReport but takes a context
+func (r *Repository) GetWeeklyReportContext(ctx context.Context, userID, guildID string, weekStart string) ([]WeeklyStats, error) {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := r.db.query(ctx, `
+		SELECT CAST(week_start AS TEXT), user_id, guild_id, voice_seconds, activity_seconds, activity_name
 		FROM weekly_stats 
 		WHERE user_id = $1 AND guild_id = $2 AND week_start = $3
 		ORDER BY voice_seconds DESC, activity_seconds DESC`,
@@ -272,7 +579,7 @@ func (r *Repository) GetWeeklyReport(userID, guildID string, weekStart string) (
 	var stats []WeeklyStats
 	for rows.Next() {
 		var stat WeeklyStats
-		if err := rows.Scan(&stat.WeekStart, &stat.UserID, &stat.GuildID, 
+		if err := rows.Scan(&stat.WeekStart, &stat.UserID, &stat.GuildID,
 			&stat.VoiceSeconds, &stat.ActivitySeconds, &stat.ActivityName); err != nil {
 			log.Printf("Error scanning weekly stats row: %v", err)
 			continue
@@ -283,15 +590,23 @@ func (r *Repository) GetWeeklyReport(userID, guildID string, weekStart string) (
 	return stats, nil
 }
 
-// GetMonthlyReport gets monthly report for a user (last 4 weeks)
-func (r *Repository) GetMonthlyReport(userID, guildID string) ([]WeeklyStats, error) {
-	rows, err := r.db.conn.Query(`
-		SELECT week_start, user_id, guild_id, voice_seconds, activity_seconds, activity_name
+// GetMonthlyReport gets monthly report for a user (weeks starting on or after since)
+func (r *Repository) GetMonthlyReport(userID, guildID, since string) ([]WeeklyStats, error) {
+	return r.GetMonthlyReportContext(context.Background(), userID, guildID, since)
+}
+
+// GetMonthlyReportContext is like GetMonthlyReport but takes a context
+func (r *Repository) GetMonthlyReportContext(ctx context.Context, userID, guildID, since string) ([]WeeklyStats, error) {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := r.db.query(ctx, `
+		SELECT CAST(week_start AS TEXT), user_id, guild_id, voice_seconds, activity_seconds, activity_name
 		FROM weekly_stats 
 		WHERE user_id = $1 AND guild_id = $2 
-		AND week_start >= CURRENT_DATE - INTERVAL '28 days'
+		AND week_start >= $3
 		ORDER BY week_start DESC`,
-		userID, guildID)
+		userID, guildID, since)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get monthly report: %w", err)
 	}
@@ -300,7 +615,7 @@ func (r *Repository) GetMonthlyReport(userID, guildID string) ([]WeeklyStats, er
 	var stats []WeeklyStats
 	for rows.Next() {
 		var stat WeeklyStats
-		if err := rows.Scan(&stat.WeekStart, &stat.UserID, &stat.GuildID, 
+		if err := rows.Scan(&stat.WeekStart, &stat.UserID, &stat.GuildID,
 			&stat.VoiceSeconds, &stat.ActivitySeconds, &stat.ActivityName); err != nil {
 			log.Printf("Error scanning monthly stats row: %v", err)
 			continue
@@ -311,6 +626,740 @@ func (r *Repository) GetMonthlyReport(userID, guildID string) ([]WeeklyStats, er
 	return stats, nil
 }
 
+// SaveOpenSession stores or updates an in-flight session
+func (r *Repository) SaveOpenSession(session OpenSession) error {
+	return r.SaveOpenSessionContext(context.Background(), session)
+}
+
+// SaveOpenSessionContext is like SaveOpenSession but takes a context
+func (r *Repository) SaveOpenSessionContext(ctx context.Context, session OpenSession) error {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	ended := sql.NullTime{Time: session.Ended, Valid: !session.Ended.IsZero()}
+	_, err := r.db.exec(ctx, `
+		INSERT INTO open_sessions (kind, user_id, guild_id, subject, started_at, credited_until, last_seen, run_id, ended_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (kind, user_id, guild_id, subject)
+		DO UPDATE SET
+			started_at = EXCLUDED.started_at,
+			credited_until = EXCLUDED.credited_until,
+			last_seen = EXCLUDED.last_seen,
+			run_id = EXCLUDED.run_id,
+			ended_at = EXCLUDED.ended_at`,
+		session.Kind, session.UserID, session.GuildID, session.Subject,
+		session.StartedAt, session.CreditedUntil, session.LastSeen, session.RunID, ended)
+	if err != nil {
+		return fmt.Errorf("failed to save open session: %w", err)
+	}
+	return nil
+}
+
+// DeleteOpenSession removes an in-flight session once it has been closed
+func (r *Repository) DeleteOpenSession(kind, userID, guildID, subject string) error {
+	return r.DeleteOpenSessionContext(context.Background(), kind, userID, guildID, subject)
+}
+
+// DeleteOpenSessionContext is like DeleteOpenSession but takes a context
+func (r *Repository) DeleteOpenSessionContext(ctx context.Context, kind, userID, guildID, subject string) error {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := r.db.exec(ctx,
+		"DELETE FROM open_sessions WHERE kind = $1 AND user_id = $2 AND guild_id = $3 AND subject = $4",
+		kind, userID, guildID, subject)
+	if err != nil {
+		return fmt.Errorf("failed to delete open session: %w", err)
+	}
+	return nil
+}
+
+// TouchOpenSessions records a heartbeat for the in-flight sessions saved by
+// a run. Sessions left behind by an earlier run keep their last heartbeat.
+func (r *Repository) TouchOpenSessions(runID string, lastSeen time.Time) error {
+	return r.TouchOpenSessionsContext(context.Background(), runID, lastSeen)
+}
+
+// TouchOpenSessionsContext is like TouchOpenSessions but takes a context
+func (r *Repository) TouchOpenSessionsContext(ctx context.Context, runID string, lastSeen time.Time) error {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := r.db.exec(ctx, "UPDATE open_sessions SET last_seen = $1 WHERE run_id = $2", lastSeen, runID)
+	if err != nil {
+		return fmt.Errorf("failed to touch open sessions: %w", err)
+	}
+	return nil
+}
+
+// GetOpenSessions gets all in-flight sessions left behind by a previous run
+func (r *Repository) GetOpenSessions() ([]OpenSession, error) {
+	return r.GetOpenSessionsContext(context.Background())
+}
+
+// GetOpenSessionsContext is like GetOpenSessions but takes a context
+func (r *Repository) GetOpenSessionsContext(ctx context.Context) ([]OpenSession, error) {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := r.db.query(ctx,
+		`SELECT kind, user_id, guild_id, subject, started_at, credited_until, last_seen, run_id, ended_at
+		FROM open_sessions`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get open sessions: %w", err)
+	}
+	defer rows.Close()
+
+	var sessions []OpenSession
+	for rows.Next() {
+		var session OpenSession
+		var creditedUntil, ended sql.NullTime
+		if err := rows.Scan(&session.Kind, &session.UserID, &session.GuildID, &session.Subject,
+			&session.StartedAt, &creditedUntil, &session.LastSeen, &session.RunID, &ended); err != nil {
+			log.Printf("Error scanning open session row: %v", err)
+			continue
+		}
+		// Sessions saved before checkpoints existed were never credited
+		session.CreditedUntil = session.StartedAt
+		if creditedUntil.Valid {
+			session.CreditedUntil = creditedUntil.Time
+		}
+		session.Ended = ended.Time
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+// AddSessionLog records a stretch of a voice or activity session in the raw
+// session log and returns its ID
+func (r *Repository) AddSessionLog(entry SessionLog) (int64, error) {
+	return r.AddSessionLogContext(context.Background(), entry)
+}
+
+// AddSessionLogContext is like AddSessionLog but takes a context
+func (r *Repository) AddSessionLogContext(ctx context.Context, entry SessionLog) (int64, error) {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	var id int64
+	err := r.db.queryRow(ctx, `
+		INSERT INTO sessions (kind, user_id, guild_id, subject, started_at, ended_at, idle, muted, deafened, streaming, video)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING id`,
+		entry.Kind, entry.UserID, entry.GuildID, entry.Subject, entry.StartedAt, entry.EndedAt,
+		entry.Idle, entry.Muted, entry.Deafened, entry.Streaming, entry.Video).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to add session log: %w", err)
+	}
+	return id, nil
+}
+
+// ExtendSessionLog moves the end of a logged session stretch
+func (r *Repository) ExtendSessionLog(id int64, endedAt time.Time) error {
+	return r.ExtendSessionLogContext(context.Background(), id, endedAt)
+}
+
+// ExtendSessionLogContext is like ExtendSessionLog but takes a context
+func (r *Repository) ExtendSessionLogContext(ctx context.Context, id int64, endedAt time.Time) error {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := r.db.exec(ctx, "UPDATE sessions SET ended_at = $1 WHERE id = $2", endedAt, id)
+	if err != nil {
+		return fmt.Errorf("failed to extend session log: %w", err)
+	}
+	return nil
+}
+
+// GetRecentSessionLogs gets a user's most recent logged voice stretches in
+// a guild and activity stretches reported there
+func (r *Repository) GetRecentSessionLogs(userID, guildID string, limit int) ([]SessionLog, error) {
+	return r.GetRecentSessionLogsContext(context.Background(), userID, guildID, limit)
+}
+
+// GetRecentSessionLogsContext is like GetRecentSessionLogs but takes a context
+func (r *Repository) GetRecentSessionLogsContext(ctx context.Context, userID, guildID string, limit int) ([]SessionLog, error) {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := r.db.query(ctx, `
+		SELECT id, kind, user_id, guild_id, subject, started_at, ended_at, idle, muted, deafened, streaming, video
+		FROM sessions
+		WHERE user_id = $1 AND guild_id = $2
+		ORDER BY started_at DESC
+		LIMIT $3`, userID, guildID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get session logs: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []SessionLog
+	for rows.Next() {
+		var entry SessionLog
+		if err := rows.Scan(&entry.ID, &entry.Kind, &entry.UserID, &entry.GuildID, &entry.Subject,
+			&entry.StartedAt, &entry.EndedAt, &entry.Idle, &entry.Muted, &entry.Deafened,
+			&entry.Streaming, &entry.Video); err != nil {
+			log.Printf("Error scanning session log row: %v", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// GetGuildSettings gets the settings for a guild, or defaults if none are stored
+func (r *Repository) GetGuildSettings(guildID string) (GuildSettings, error) {
+	return r.GetGuildSettingsContext(context.Background(), guildID)
+}
+
+// GetGuildSettingsContext is like GetGuildSettings but takes a context
+func (r *Repository) GetGuildSettingsContext(ctx context.Context, guildID string) (GuildSettings, error) {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	settings := GuildSettings{GuildID: guildID, MinHumans: 1}
+	err := r.db.queryRow(ctx,
+		"SELECT timezone, exclude_deafened, min_humans FROM guild_settings WHERE guild_id = $1",
+		guildID).Scan(&settings.Timezone, &settings.ExcludeDeafened, &settings.MinHumans)
+	if err != nil && err != sql.ErrNoRows {
+		return settings, fmt.Errorf("failed to get guild settings: %w", err)
+	}
+	return settings, nil
+}
+
+// SaveGuildSettings stores the settings for a guild
+func (r *Repository) SaveGuildSettings(settings GuildSettings) error {
+	return r.SaveGuildSettingsContext(context.Background(), settings)
+}
+
+// SaveGuildSettingsContext is like SaveGuildSettings but takes a context
+func (r *Repository) SaveGuildSettingsContext(ctx context.Context, settings GuildSettings) error {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := r.db.exec(ctx, `
+		INSERT INTO guild_settings (guild_id, timezone, exclude_deafened, min_humans)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (guild_id)
+		DO UPDATE SET
+			timezone = EXCLUDED.timezone,
+			exclude_deafened = EXCLUDED.exclude_deafened,
+			min_humans = EXCLUDED.min_humans`,
+		settings.GuildID, settings.Timezone, settings.ExcludeDeafened, settings.MinHumans)
+	if err != nil {
+		return fmt.Errorf("failed to save guild settings: %w", err)
+	}
+	return nil
+}
+
+// GetUserSettings gets the settings for a user, or defaults if none are stored
+func (r *Repository) GetUserSettings(userID string) (UserSettings, error) {
+	return r.GetUserSettingsContext(context.Background(), userID)
+}
+
+// GetUserSettingsContext is like GetUserSettings but takes a context
+func (r *Repository) GetUserSettingsContext(ctx context.Context, userID string) (UserSettings, error) {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	settings := UserSettings{UserID: userID}
+	err := r.db.queryRow(ctx,
+		"SELECT timezone FROM user_settings WHERE user_id = $1",
+		userID).Scan(&settings.Timezone)
+	if err != nil && err != sql.ErrNoRows {
+		return settings, fmt.Errorf("failed to get user settings: %w", err)
+	}
+	return settings, nil
+}
+
+// SaveUserSettings stores the settings for a user
+func (r *Repository) SaveUserSettings(settings UserSettings) error {
+	return r.SaveUserSettingsContext(context.Background(), settings)
+}
+
+// SaveUserSettingsContext is like SaveUserSettings but takes a context
+func (r *Repository) SaveUserSettingsContext(ctx context.Context, settings UserSettings) error {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := r.db.exec(ctx, `
+		INSERT INTO user_settings (user_id, timezone)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET timezone = EXCLUDED.timezone`,
+		settings.UserID, settings.Timezone)
+	if err != nil {
+		return fmt.Errorf("failed to save user settings: %w", err)
+	}
+	return nil
+}
+
+// GetTimezones gets every guild and user timezone that is set, keyed by
+// guild and user ID
+func (r *Repository) GetTimezones() (guilds, users map[string]string, err error) {
+	return r.GetTimezonesContext(context.Background())
+}
+
+// GetTimezonesContext is like GetTimezones but takes a context
+func (r *Repository) GetTimezonesContext(ctx context.Context) (guilds, users map[string]string, err error) {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	guilds, err = r.timezones(ctx, "SELECT guild_id, timezone FROM guild_settings WHERE timezone <> ''")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get guild timezones: %w", err)
+	}
+	users, err = r.timezones(ctx, "SELECT user_id, timezone FROM user_settings WHERE timezone <> ''")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get user timezones: %w", err)
+	}
+	return guilds, users, nil
+}
+
+// timezones reads ID and timezone pairs into a map
+func (r *Repository) timezones(ctx context.Context, query string) (map[string]string, error) {
+	rows, err := r.db.query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	timezones := make(map[string]string)
+	for rows.Next() {
+		var id, timezone string
+		if err := rows.Scan(&id, &timezone); err != nil {
+			return nil, err
+		}
+		timezones[id] = timezone
+	}
+	return timezones, rows.Err()
+}
+
+// GetIgnoredChannels gets the voice channels excluded from stats in a guild
+func (r *Repository) GetIgnoredChannels(guildID string) ([]string, error) {
+	return r.GetIgnoredChannelsContext(context.Background(), guildID)
+}
+
+// GetIgnoredChannelsContext is like GetIgnoredChannels but takes a context
+func (r *Repository) GetIgnoredChannelsContext(ctx context.Context, guildID string) ([]string, error) {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := r.db.query(ctx,
+		"SELECT channel_id FROM ignored_channels WHERE guild_id = $1",
+		guildID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ignored channels: %w", err)
+	}
+	defer rows.Close()
+
+	var channelIDs []string
+	for rows.Next() {
+		var channelID string
+		if err := rows.Scan(&channelID); err != nil {
+			log.Printf("Error scanning ignored channel row: %v", err)
+			continue
+		}
+		channelIDs = append(channelIDs, channelID)
+	}
+
+	return channelIDs, nil
+}
+
+// AddIgnoredChannel excludes a voice channel from stats in a guild
+func (r *Repository) AddIgnoredChannel(guildID, channelID string) error {
+	return r.AddIgnoredChannelContext(context.Background(), guildID, channelID)
+}
+
+// AddIgnoredChannelContext is like AddIgnoredChannel but takes a context
+func (r *Repository) AddIgnoredChannelContext(ctx context.Context, guildID, channelID string) error {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := r.db.exec(ctx, `
+		INSERT INTO ignored_channels (guild_id, channel_id)
+		VALUES ($1, $2)
+		ON CONFLICT (guild_id, channel_id) DO NOTHING`,
+		guildID, channelID)
+	if err != nil {
+		return fmt.Errorf("failed to add ignored channel: %w", err)
+	}
+	return nil
+}
+
+// RemoveIgnoredChannel includes a previously ignored voice channel in stats again
+func (r *Repository) RemoveIgnoredChannel(guildID, channelID string) error {
+	return r.RemoveIgnoredChannelContext(context.Background(), guildID, channelID)
+}
+
+// RemoveIgnoredChannelContext is like RemoveIgnoredChannel but takes a context
+func (r *Repository) RemoveIgnoredChannelContext(ctx context.Context, guildID, channelID string) error {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := r.db.exec(ctx,
+		"DELETE FROM ignored_channels WHERE guild_id = $1 AND channel_id = $2",
+		guildID, channelID)
+	if err != nil {
+		return fmt.Errorf("failed to remove ignored channel: %w", err)
+	}
+	return nil
+}
+
+// GetActivityAliases gets the activity aliases of a guild
+func (r *Repository) GetActivityAliases(guildID string) ([]ActivityAlias, error) {
+	return r.GetActivityAliasesContext(context.Background(), guildID)
+}
+
+// GetActivityAliasesContext is like GetActivityAliases but takes a context
+func (r *Repository) GetActivityAliasesContext(ctx context.Context, guildID string) ([]ActivityAlias, error) {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := r.db.query(ctx,
+		"SELECT alias, activity_name FROM activity_aliases WHERE guild_id = $1 ORDER BY alias",
+		guildID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get activity aliases: %w", err)
+	}
+	defer rows.Close()
+
+	var aliases []ActivityAlias
+	for rows.Next() {
+		alias := ActivityAlias{GuildID: guildID}
+		if err := rows.Scan(&alias.Alias, &alias.ActivityName); err != nil {
+			log.Printf("Error scanning activity alias row: %v", err)
+			continue
+		}
+		aliases = append(aliases, alias)
+	}
+
+	return aliases, nil
+}
+
+// SaveActivityAlias creates or replaces an activity alias
+func (r *Repository) SaveActivityAlias(alias ActivityAlias) error {
+	return r.SaveActivityAliasContext(context.Background(), alias)
+}
+
+// SaveActivityAliasContext is like SaveActivityAlias but takes a context
+func (r *Repository) SaveActivityAliasContext(ctx context.Context, alias ActivityAlias) error {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := r.db.exec(ctx, `
+		INSERT INTO activity_aliases (guild_id, alias, activity_name)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (guild_id, alias) DO UPDATE SET activity_name = EXCLUDED.activity_name`,
+		alias.GuildID, alias.Alias, alias.ActivityName)
+	if err != nil {
+		return fmt.Errorf("failed to save activity alias: %w", err)
+	}
+	return nil
+}
+
+// DeleteActivityAlias removes an activity alias from a guild
+func (r *Repository) DeleteActivityAlias(guildID, alias string) error {
+	return r.DeleteActivityAliasContext(context.Background(), guildID, alias)
+}
+
+// DeleteActivityAliasContext is like DeleteActivityAlias but takes a context
+func (r *Repository) DeleteActivityAliasContext(ctx context.Context, guildID, alias string) error {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := r.db.exec(ctx,
+		"DELETE FROM activity_aliases WHERE guild_id = $1 AND alias = $2",
+		guildID, alias)
+	if err != nil {
+		return fmt.Errorf("failed to delete activity alias: %w", err)
+	}
+	return nil
+}
+
+// AddListeningSession records a played track in the listening history
+func (r *Repository) AddListeningSession(entry ListeningSession) error {
+	return r.AddListeningSessionContext(context.Background(), entry)
+}
+
+// AddListeningSessionContext is like AddListeningSession but takes a context
+func (r *Repository) AddListeningSessionContext(ctx context.Context, entry ListeningSession) error {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := r.db.exec(ctx, `
+		INSERT INTO listening_sessions (user_id, track, artist, album, started_at, ended_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		entry.UserID, entry.Track, entry.Artist, entry.Album, entry.StartedAt, entry.EndedAt)
+	if err != nil {
+		return fmt.Errorf("failed to add listening session: %w", err)
+	}
+	return nil
+}
+
+// AddTrackSeconds adds listening seconds of a track for a user
+func (r *Repository) AddTrackSeconds(userID, artist, track string, seconds int64) error {
+	return r.AddTrackSecondsContext(context.Background(), userID, artist, track, seconds)
+}
+
+// AddTrackSecondsContext is like AddTrackSeconds but takes a context
+func (r *Repository) AddTrackSecondsContext(ctx context.Context, userID, artist, track string, seconds int64) error {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := r.db.exec(ctx, `
+		INSERT INTO track_hours (user_id, artist, track, total_seconds)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, artist, track) DO UPDATE SET total_seconds = track_hours.total_seconds + EXCLUDED.total_seconds`,
+		userID, artist, track, seconds)
+	if err != nil {
+		return fmt.Errorf("failed to add track seconds: %w", err)
+	}
+	return nil
+}
+
+// AddGuildTrackSeconds adds listening seconds of a track for a user in a guild
+func (r *Repository) AddGuildTrackSeconds(userID, guildID, artist, track string, seconds int64) error {
+	return r.AddGuildTrackSecondsContext(context.Background(), userID, guildID, artist, track, seconds)
+}
+
+// AddGuildTrackSecondsContext is like AddGuildTrackSeconds but takes a context
+func (r *Repository) AddGuildTrackSecondsContext(ctx context.Context, userID, guildID, artist, track string, seconds int64) error {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := r.db.exec(ctx, `
+		INSERT INTO guild_track_hours (user_id, guild_id, artist, track, total_seconds)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, guild_id, artist, track) DO UPDATE SET total_seconds = guild_track_hours.total_seconds + EXCLUDED.total_seconds`,
+		userID, guildID, artist, track, seconds)
+	if err != nil {
+		return fmt.Errorf("failed to add guild track seconds: %w", err)
+	}
+	return nil
+}
+
+// GetTopArtists gets the most listened artists of a user, or of everyone in
+// guildID when userID is empty
+func (r *Repository) GetTopArtists(userID, guildID string, limit int) ([]TrackHours, error) {
+	return r.GetTopArtistsContext(context.Background(), userID, guildID, limit)
+}
+
+// GetTopArtistsContext is like GetTopArtists but takes a context
+func (r *Repository) GetTopArtistsContext(ctx context.Context, userID, guildID string, limit int) ([]TrackHours, error) {
+	query := `
+		SELECT artist, '', SUM(total_seconds) AS seconds
+		FROM track_hours
+		WHERE user_id = $1
+		GROUP BY artist
+		ORDER BY seconds DESC
+		LIMIT $2`
+	args := []interface{}{userID, limit}
+	if userID == "" {
+		query = `
+			SELECT artist, '', SUM(total_seconds) AS seconds
+			FROM guild_track_hours
+			WHERE guild_id = $1
+			GROUP BY artist
+			ORDER BY seconds DESC
+			LIMIT $2`
+		args = []interface{}{guildID, limit}
+	}
+	return r.topTracks(ctx, "artists", query, args...)
+}
+
+// GetTopTracks gets the most listened tracks of a user, or of everyone in
+// guildID when userID is empty
+func (r *Repository) GetTopTracks(userID, guildID string, limit int) ([]TrackHours, error) {
+	return r.GetTopTracksContext(context.Background(), userID, guildID, limit)
+}
+
+// GetTopTracksContext is like GetTopTracks but takes a context
+func (r *Repository) GetTopTracksContext(ctx context.Context, userID, guildID string, limit int) ([]TrackHours, error) {
+	query := `
+		SELECT artist, track, SUM(total_seconds) AS seconds
+		FROM track_hours
+		WHERE user_id = $1
+		GROUP BY artist, track
+		ORDER BY seconds DESC
+		LIMIT $2`
+	args := []interface{}{userID, limit}
+	if userID == "" {
+		query = `
+			SELECT artist, track, SUM(total_seconds) AS seconds
+			FROM guild_track_hours
+			WHERE guild_id = $1
+			GROUP BY artist, track
+			ORDER BY seconds DESC
+			LIMIT $2`
+		args = []interface{}{guildID, limit}
+	}
+	return r.topTracks(ctx, "tracks", query, args...)
+}
+
+// topTracks runs a top artists or tracks query
+func (r *Repository) topTracks(ctx context.Context, what, query string, args ...interface{}) ([]TrackHours, error) {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := r.db.query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get top %s: %w", what, err)
+	}
+	defer rows.Close()
+
+	var tracks []TrackHours
+	for rows.Next() {
+		var track TrackHours
+		if err := rows.Scan(&track.Artist, &track.Track, &track.TotalSeconds); err != nil {
+			log.Printf("Error scanning top %s row: %v", what, err)
+			continue
+		}
+		tracks = append(tracks, track)
+	}
+
+	return tracks, nil
+}
+
+// AddActivityDetailSeconds adds seconds spent in a rich presence detail,
+// such as a game mode or map, of an activity
+func (r *Repository) AddActivityDetailSeconds(userID, activityName, detail string, seconds int64) error {
+	return r.AddActivityDetailSecondsContext(context.Background(), userID, activityName, detail, seconds)
+}
+
+// AddActivityDetailSecondsContext is like AddActivityDetailSeconds but takes a context
+func (r *Repository) AddActivityDetailSecondsContext(ctx context.Context, userID, activityName, detail string, seconds int64) error {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := r.db.exec(ctx, `
+		INSERT INTO activity_detail_hours (user_id, activity_name, detail, total_seconds)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, activity_name, detail) DO UPDATE SET total_seconds = activity_detail_hours.total_seconds + EXCLUDED.total_seconds`,
+		userID, activityName, detail, seconds)
+	if err != nil {
+		return fmt.Errorf("failed to add activity detail seconds: %w", err)
+	}
+	return nil
+}
+
+// GetActivityDetailHours gets a user's time per rich presence detail of an activity
+func (r *Repository) GetActivityDetailHours(userID, activityName string, limit int) ([]ActivityDetailHours, error) {
+	return r.GetActivityDetailHoursContext(context.Background(), userID, activityName, limit)
+}
+
+// GetActivityDetailHoursContext is like GetActivityDetailHours but takes a context
+func (r *Repository) GetActivityDetailHoursContext(ctx context.Context, userID, activityName string, limit int) ([]ActivityDetailHours, error) {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := r.db.query(ctx, `
+		SELECT detail, SUM(total_seconds) AS seconds
+		FROM activity_detail_hours
+		WHERE user_id = $1 AND LOWER(activity_name) = LOWER($2)
+		GROUP BY detail
+		ORDER BY seconds DESC
+		LIMIT $3`,
+		userID, activityName, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get activity detail hours: %w", err)
+	}
+	defer rows.Close()
+
+	var details []ActivityDetailHours
+	for rows.Next() {
+		var detail ActivityDetailHours
+		if err := rows.Scan(&detail.Detail, &detail.TotalSeconds); err != nil {
+			log.Printf("Error scanning activity detail row: %v", err)
+			continue
+		}
+		details = append(details, detail)
+	}
+
+	return details, nil
+}
+
+// GetDetailActivities gets the activities whose rich presence details are
+// tracked in a guild, in their utils.ActivityKey form
+func (r *Repository) GetDetailActivities(guildID string) ([]string, error) {
+	return r.GetDetailActivitiesContext(context.Background(), guildID)
+}
+
+// GetDetailActivitiesContext is like GetDetailActivities but takes a context
+func (r *Repository) GetDetailActivitiesContext(ctx context.Context, guildID string) ([]string, error) {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := r.db.query(ctx,
+		"SELECT activity_key FROM detail_activities WHERE guild_id = $1 ORDER BY activity_key",
+		guildID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get detail activities: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			log.Printf("Error scanning detail activity row: %v", err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// AddDetailActivity starts tracking an activity's rich presence details in a guild
+func (r *Repository) AddDetailActivity(guildID, activityKey string) error {
+	return r.AddDetailActivityContext(context.Background(), guildID, activityKey)
+}
+
+// AddDetailActivityContext is like AddDetailActivity but takes a context
+func (r *Repository) AddDetailActivityContext(ctx context.Context, guildID, activityKey string) error {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := r.db.exec(ctx, `
+		INSERT INTO detail_activities (guild_id, activity_key)
+		VALUES ($1, $2)
+		ON CONFLICT (guild_id, activity_key) DO NOTHING`,
+		guildID, activityKey)
+	if err != nil {
+		return fmt.Errorf("failed to add detail activity: %w", err)
+	}
+	return nil
+}
+
+// RemoveDetailActivity stops tracking an activity's rich presence details in a guild
+func (r *Repository) RemoveDetailActivity(guildID, activityKey string) error {
+	return r.RemoveDetailActivityContext(context.Background(), guildID, activityKey)
+}
+
+// RemoveDetailActivityContext is like RemoveDetailActivity but takes a context
+func (r *Repository) RemoveDetailActivityContext(ctx context.Context, guildID, activityKey string) error {
+	ctx, cancel := r.db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := r.db.exec(ctx,
+		"DELETE FROM detail_activities WHERE guild_id = $1 AND activity_key = $2",
+		guildID, activityKey)
+	if err != nil {
+		return fmt.Errorf("failed to remove detail activity: %w", err)
+	}
+	return nil
+}
+
+// ActivityAlias maps an alternative activity name to the name its time is
+// recorded under in a guild. Alias is stored in its utils.ActivityKey form.
+type ActivityAlias struct {
+	GuildID      string
+	Alias        string
+	ActivityName string
+}
+
 // ActivityHours represents activity hours data
 type ActivityHours struct {
 	UserID       string
@@ -318,6 +1367,19 @@ type ActivityHours struct {
 	TotalSeconds int64
 }
 
+// ActivityTypeHours represents a user's total activity time of one type
+type ActivityTypeHours struct {
+	ActivityType string
+	TotalSeconds int64
+}
+
+// ActivityDetailHours represents a user's time in one rich presence detail
+// of an activity, such as "Competitive - Ascent"
+type ActivityDetailHours struct {
+	Detail       string
+	TotalSeconds int64
+}
+
 // VoiceChannelHours represents voice channel hours data
 type VoiceChannelHours struct {
 	UserID       string
@@ -326,6 +1388,17 @@ type VoiceChannelHours struct {
 	TotalSeconds int64
 }
 
+// VoiceStateHours represents the muted, deafened, go-live and camera
+// breakdown of a user's voice time in a guild
+type VoiceStateHours struct {
+	UserID           string
+	GuildID          string
+	MutedSeconds     int64
+	DeafenedSeconds  int64
+	StreamingSeconds int64
+	VideoSeconds     int64
+}
+
 // DailyStats represents daily statistics data
 type DailyStats struct {
 	Date            string
@@ -356,9 +1429,97 @@ type LeaderboardEntry struct {
 
 // UserComparison represents user comparison data
 type UserComparison struct {
-	UserID         string
-	Username       string
-	VoiceSeconds   int64
-	TopActivities  []ActivityHours
-	ChannelHours   []VoiceChannelHours
+	UserID        string
+	Username      string
+	VoiceSeconds  int64
+	TopActivities []ActivityHours
+	ChannelHours  []VoiceChannelHours
+}
+
+// SessionLog represents a stretch of a closed or checkpointed session in the
+// raw session log. A voice session is split into several stretches when its
+// idle, mute, deafen, go-live or camera state changes.
+type SessionLog struct {
+	ID        int64
+	Kind      string
+	UserID    string
+	GuildID   string
+	Subject   string
+	StartedAt time.Time
+	EndedAt   time.Time
+	Idle      bool
+	Muted     bool
+	Deafened  bool
+	Streaming bool
+	Video     bool
+}
+
+// GuildSettings represents per-guild configuration. An empty Timezone
+// means the bot's default timezone. MinHumans is how many humans must be in
+// a voice channel, the user included, for voice time to count.
+type GuildSettings struct {
+	GuildID         string
+	Timezone        string
+	ExcludeDeafened bool
+	MinHumans       int
+}
+
+// UserSettings represents per-user configuration. An empty Timezone means
+// the guild's timezone.
+type UserSettings struct {
+	UserID   string
+	Timezone string
+}
+
+// Activity types, recorded per activity name
+const (
+	ActivityTypePlaying   = "playing"
+	ActivityTypeStreaming = "streaming"
+	ActivityTypeListening = "listening"
+	ActivityTypeWatching  = "watching"
+	ActivityTypeCompeting = "competing"
+	ActivityTypeCustom    = "custom"
+)
+
+// Open session kinds
+const (
+	SessionKindVoice    = "voice"
+	SessionKindActivity = "activity"
+)
+
+// OpenSession represents an in-flight voice or activity session.
+// Subject is the channel ID for voice sessions and the activity name
+// for activity sessions. CreditedUntil is the time up to which the
+// session has already been written to the totals. RunID identifies the
+// run that saved the session, and Ended is when an activity stopped being
+// reported while it may still come back, or zero.
+type OpenSession struct {
+	Kind          string
+	UserID        string
+	GuildID       string
+	Subject       string
+	StartedAt     time.Time
+	CreditedUntil time.Time
+	LastSeen      time.Time
+	RunID         string
+	Ended         time.Time
+}
+
+// ListeningSession represents a track played on Spotify in the listening
+// history. Artist is every artist of the track as reported by Spotify.
+type ListeningSession struct {
+	UserID    string
+	Track     string
+	Artist    string
+	Album     string
+	StartedAt time.Time
+	EndedAt   time.Time
+}
+
+// TrackHours represents the listening time of an artist, or of one of its
+// tracks when Track is set
+type TrackHours struct {
+	Artist       string
+	Track        string
+	TotalSeconds int64
 }
@@ -0,0 +1,53 @@
+package database
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestRepository opens a migrated SQLite database in a temporary
+// directory
+func newTestRepository(t *testing.T) *Repository {
+	t.Helper()
+	db, err := New(DialectSQLite, filepath.Join(t.TempDir(), "playstats.db"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return NewRepository(db)
+}
+
+func TestTouchOpenSessionsOnlyTouchesRun(t *testing.T) {
+	repository := newTestRepository(t)
+	ctx := context.Background()
+	start := time.Date(2026, 1, 5, 10, 0, 0, 0, time.UTC)
+	ended := start.Add(20 * time.Minute)
+
+	repository.SaveOpenSessionContext(ctx, OpenSession{Kind: SessionKindActivity, UserID: "u1", GuildID: "g1", Subject: "Valorant",
+		StartedAt: start, CreditedUntil: start, LastSeen: start.Add(30 * time.Minute), RunID: "old", Ended: ended})
+	repository.SaveOpenSessionContext(ctx, OpenSession{Kind: SessionKindVoice, UserID: "u1", GuildID: "g1", Subject: "c1",
+		StartedAt: start, CreditedUntil: start, LastSeen: start.Add(time.Hour), RunID: "new"})
+
+	if err := repository.TouchOpenSessionsContext(ctx, "new", start.Add(2*time.Hour)); err != nil {
+		t.Fatalf("TouchOpenSessionsContext: %v", err)
+	}
+
+	sessions, err := repository.GetOpenSessionsContext(ctx)
+	if err != nil || len(sessions) != 2 {
+		t.Fatalf("GetOpenSessionsContext = %+v, %v, want 2 sessions", sessions, err)
+	}
+	for _, session := range sessions {
+		switch session.RunID {
+		case "old":
+			if !session.LastSeen.Equal(start.Add(30*time.Minute)) || !session.Ended.Equal(ended) {
+				t.Errorf("old run session = %+v, want its heartbeat and end kept", session)
+			}
+		case "new":
+			if !session.LastSeen.Equal(start.Add(2*time.Hour)) || !session.Ended.IsZero() {
+				t.Errorf("new run session = %+v, want it touched and not ended", session)
+			}
+		}
+	}
+}
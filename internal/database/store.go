@@ -0,0 +1,76 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+// Store is the storage used by the bot for stats, sessions and settings.
+// Repository implements it on top of the database, BufferedStore batches
+// a Repository's stat writes and MemoryStore keeps everything in memory.
+// Every method takes a context so callers can cancel slow calls.
+type Store interface {
+	// Totals
+	AddVoiceSecondsContext(ctx context.Context, userID, guildID string, seconds int64) error
+	AddActivitySecondsContext(ctx context.Context, userID, activityName string, seconds int64) error
+	AddGuildActivitySecondsContext(ctx context.Context, userID, guildID, activityName string, seconds int64) error
+	AddChannelSecondsContext(ctx context.Context, userID, guildID, channelID string, seconds int64) error
+	AddIdleSecondsContext(ctx context.Context, userID, guildID string, seconds int64) error
+	AddVoiceStateSecondsContext(ctx context.Context, userID, guildID string, muted, deafened, streaming, video int64) error
+	GetVoiceHoursContext(ctx context.Context, userID, guildID string) (int64, error)
+	GetIdleHoursContext(ctx context.Context, userID, guildID string) (int64, error)
+	GetVoiceStateHoursContext(ctx context.Context, userID, guildID string) (VoiceStateHours, error)
+	GetActivityHoursContext(ctx context.Context, userID, activityName string) (int64, error)
+	GetTopActivitiesContext(ctx context.Context, userID string, limit int) ([]ActivityHours, error)
+	GetActivityTypeHoursContext(ctx context.Context, userID string) ([]ActivityTypeHours, error)
+	AddActivityDetailSecondsContext(ctx context.Context, userID, activityName, detail string, seconds int64) error
+	GetActivityDetailHoursContext(ctx context.Context, userID, activityName string, limit int) ([]ActivityDetailHours, error)
+	GetVoiceChannelHoursContext(ctx context.Context, userID, guildID string) ([]VoiceChannelHours, error)
+
+	// Periods and reports
+	AddDailyStatsContext(ctx context.Context, date, userID, guildID string, voiceSeconds, activitySeconds int64, activityName string) error
+	AddWeeklyStatsContext(ctx context.Context, weekStart, userID, guildID string, voiceSeconds, activitySeconds int64, activityName string) error
+	GetVoiceLeaderboardContext(ctx context.Context, guildID string, limit int, excludeDeafened bool) ([]LeaderboardEntry, error)
+	GetActivityLeaderboardContext(ctx context.Context, guildID, activityName string, limit int) ([]LeaderboardEntry, error)
+	GetUserComparisonContext(ctx context.Context, userID1, userID2, guildID string) ([]UserComparison, error)
+	GetWeeklyReportContext(ctx context.Context, userID, guildID string, weekStart string) ([]WeeklyStats, error)
+	GetMonthlyReportContext(ctx context.Context, userID, guildID, since string) ([]WeeklyStats, error)
+
+	// Open sessions and the session log
+	SaveOpenSessionContext(ctx context.Context, session OpenSession) error
+	DeleteOpenSessionContext(ctx context.Context, kind, userID, guildID, subject string) error
+	TouchOpenSessionsContext(ctx context.Context, runID string, lastSeen time.Time) error
+	GetOpenSessionsContext(ctx context.Context) ([]OpenSession, error)
+	AddSessionLogContext(ctx context.Context, entry SessionLog) (int64, error)
+	ExtendSessionLogContext(ctx context.Context, id int64, endedAt time.Time) error
+	GetRecentSessionLogsContext(ctx context.Context, userID, guildID string, limit int) ([]SessionLog, error)
+
+	// Settings
+	GetGuildSettingsContext(ctx context.Context, guildID string) (GuildSettings, error)
+	SaveGuildSettingsContext(ctx context.Context, settings GuildSettings) error
+	GetUserSettingsContext(ctx context.Context, userID string) (UserSettings, error)
+	SaveUserSettingsContext(ctx context.Context, settings UserSettings) error
+	GetIgnoredChannelsContext(ctx context.Context, guildID string) ([]string, error)
+	AddIgnoredChannelContext(ctx context.Context, guildID, channelID string) error
+	RemoveIgnoredChannelContext(ctx context.Context, guildID, channelID string) error
+	GetActivityAliasesContext(ctx context.Context, guildID string) ([]ActivityAlias, error)
+	SaveActivityAliasContext(ctx context.Context, alias ActivityAlias) error
+	DeleteActivityAliasContext(ctx context.Context, guildID, alias string) error
+	SaveActivityTypeContext(ctx context.Context, activityName, activityType string) error
+	GetDetailActivitiesContext(ctx context.Context, guildID string) ([]string, error)
+	AddDetailActivityContext(ctx context.Context, guildID, activityKey string) error
+	RemoveDetailActivityContext(ctx context.Context, guildID, activityKey string) error
+
+	// Listening history
+	AddListeningSessionContext(ctx context.Context, entry ListeningSession) error
+	AddTrackSecondsContext(ctx context.Context, userID, artist, track string, seconds int64) error
+	AddGuildTrackSecondsContext(ctx context.Context, userID, guildID, artist, track string, seconds int64) error
+	GetTopArtistsContext(ctx context.Context, userID, guildID string, limit int) ([]TrackHours, error)
+	GetTopTracksContext(ctx context.Context, userID, guildID string, limit int) ([]TrackHours, error)
+}
+
+var (
+	_ Store = (*Repository)(nil)
+	_ Store = (*MemoryStore)(nil)
+	_ Store = (*BufferedStore)(nil)
+)
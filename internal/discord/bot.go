@@ -1,13 +1,17 @@
 package discord
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
 
+	"playstats/internal/config"
 	"playstats/internal/database"
 	"playstats/internal/models"
 	"playstats/pkg/utils"
@@ -15,16 +19,40 @@ import (
 
 // Bot represents the Discord bot
 type Bot struct {
-	session     *discordgo.Session
-	repository  *database.Repository
-	sessions    map[string]models.VoiceSession // key: guildID:userID -> voice session
-	activitySessions map[string]time.Time     // key: userID:activity -> startTime
-	tzUTC7      *time.Location
+	session               *discordgo.Session
+	repository            database.Store
+	sessions              map[string]models.VoiceSession    // key: guildID:userID -> voice session
+	activitySessions      map[string]models.ActivitySession // key: userID:activity -> activity session
+	occupancy             map[string]map[string]bool        // key: guildID:channelID -> human user IDs in the channel
+	trackingMu            sync.Mutex                        // guards sessions, activitySessions and occupancy
+	storeQueue            []func()                          // store and settings I/O queued while holding trackingMu
+	storeMu               sync.Mutex                        // guards storeQueue
+	storeRunMu            sync.Mutex                        // serializes runStoreQueue so queued work runs in order
+	musicSessions         map[string]*MusicSession          // key: guildID
+	musicMu               sync.Mutex                        // guards musicSessions and the sessions in it
+	recovered             map[string]database.OpenSession   // key: kind:guildID:userID:subject -> session from a previous run
+	recoveredMu           sync.Mutex
+	runID                 string // marks the open sessions saved by this run, so heartbeats leave recovered ones alone
+	defaultTZ             *time.Location
+	guildSettingsCache    map[string]database.GuildSettings // key: guildID
+	userSettingsCache     map[string]database.UserSettings  // key: userID
+	ignoredChannelsCache  map[string]map[string]bool        // key: guildID -> ignored channel IDs
+	activityAliasesCache  map[string]map[string]string      // key: guildID -> alias key -> activity name
+	detailActivitiesCache map[string]map[string]bool        // key: guildID -> activity keys with tracked details
+	locationsCache        map[string]*time.Location         // key: IANA timezone name, nil if unknown
+	settingsMu            sync.RWMutex
+	checkpointInterval    time.Duration
+	shutdownTimeout       time.Duration
+	trackCustomStatus     bool
+	activityGrace         time.Duration // how long a missing activity may return before its session closes
+	activityMinDuration   time.Duration
+	ctx                   context.Context // cancelled by Stop, bounds store calls from handlers
+	cancel                context.CancelFunc
 }
 
 // New creates a new Discord bot
-func New(token string, repository *database.Repository) (*Bot, error) {
-	session, err := discordgo.New("Bot " + token)
+func New(cfg *config.Config, repository database.Store) (*Bot, error) {
+	session, err := discordgo.New("Bot " + cfg.DiscordToken)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create Discord session: %w", err)
 	}
@@ -34,15 +62,36 @@ func New(token string, repository *database.Repository) (*Bot, error) {
 		discordgo.IntentsGuildVoiceStates | 
 		discordgo.IntentsGuildMessages
 
+	ctx, cancel := context.WithCancel(context.Background())
 	bot := &Bot{
-		session:          session,
-		repository:       repository,
-		sessions:         make(map[string]models.VoiceSession),
-		activitySessions: make(map[string]time.Time),
-		tzUTC7:           time.FixedZone("UTC+7", 7*3600),
+		session:               session,
+		repository:            repository,
+		sessions:              make(map[string]models.VoiceSession),
+		activitySessions:      make(map[string]models.ActivitySession),
+		occupancy:             make(map[string]map[string]bool),
+		musicSessions:         make(map[string]*MusicSession),
+		recovered:             make(map[string]database.OpenSession),
+		runID:                 strconv.FormatInt(time.Now().UnixNano(), 36),
+		defaultTZ:             cfg.DefaultTimezone,
+		guildSettingsCache:    make(map[string]database.GuildSettings),
+		userSettingsCache:     make(map[string]database.UserSettings),
+		ignoredChannelsCache:  make(map[string]map[string]bool),
+		activityAliasesCache:  make(map[string]map[string]string),
+		detailActivitiesCache: make(map[string]map[string]bool),
+		locationsCache:        make(map[string]*time.Location),
+		checkpointInterval:    cfg.CheckpointInterval,
+		shutdownTimeout:       cfg.ShutdownTimeout,
+		trackCustomStatus:     cfg.TrackCustomStatus,
+		activityGrace:         cfg.ActivityGracePeriod,
+		activityMinDuration:   cfg.ActivityMinDuration,
+		ctx:                   ctx,
+		cancel:                cancel,
 	}
 
 	// Add event handlers
+	session.AddHandler(bot.ready)
+	session.AddHandler(bot.guildCreate)
+	session.AddHandler(bot.guildDelete)
 	session.AddHandler(bot.voiceStateUpdate)
 	session.AddHandler(bot.messageCreate)
 	session.AddHandler(bot.presenceUpdate)
@@ -52,126 +101,48 @@ func New(token string, repository *database.Repository) (*Bot, error) {
 
 // Start starts the bot
 func (b *Bot) Start() error {
+	b.recoverOpenSessions(b.ctx)
+
 	if err := b.session.Open(); err != nil {
 		return fmt.Errorf("failed to open Discord connection: %w", err)
 	}
 
+	go b.heartbeat()
+	go b.checkpoint()
+
 	fmt.Println("✅ Bot is running...")
 	return nil
 }
 
-// Stop stops the bot
+// Stop stops the bot, stopping music players and flushing open sessions.
+// The gateway is closed before flushing so no new events reopen sessions.
+// Store calls still running in handlers, and queued work that captured
+// their context, are only cancelled once the flush is done or timed out,
+// so credited time isn't dropped on the way out.
 func (b *Bot) Stop() error {
-	return b.session.Close()
-}
+	now := time.Now().UTC()
 
-// voiceStateUpdate handles voice state updates
-func (b *Bot) voiceStateUpdate(s *discordgo.Session, vs *discordgo.VoiceStateUpdate) {
-	userID := vs.UserID
-	guildID := vs.GuildID
-	key := guildID + ":" + userID
+	b.stopAllMusic()
+	err := b.session.Close()
 
-	// Get user info
-	user, err := s.User(userID)
-	username := userID
-	if err == nil && user != nil {
-		username = user.Username
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), b.shutdownTimeout)
+	defer cancel()
 
-	// Join channel
-	if vs.ChannelID != "" && b.sessions[key].Start.IsZero() {
-		b.sessions[key] = models.VoiceSession{
-			Start:     time.Now().UTC(),
-			ChannelID: vs.ChannelID,
-		}
-		
-		// Get channel info
-		channel, err := s.Channel(vs.ChannelID)
-		channelName := vs.ChannelID
-		if err == nil && channel != nil {
-			channelName = channel.Name
-		}
-		
-		fmt.Printf("➡️ Join: %s (%s) %s channel=%s (%s)\n", 
-			username, userID, b.sessions[key].Start.In(b.tzUTC7), vs.ChannelID, channelName)
-	}
-
-	// Leave channel
-	if vs.ChannelID == "" && !b.sessions[key].Start.IsZero() {
-		start := b.sessions[key].Start
-		channelID := b.sessions[key].ChannelID
-		durationSeconds := int64(time.Since(start).Seconds())
-		delete(b.sessions, key)
-
-		// Get channel info for leave message
-		channel, err := s.Channel(channelID)
-		channelName := channelID
-		if err == nil && channel != nil {
-			channelName = channel.Name
-		}
+	done := make(chan struct{})
+	go func() {
+		b.closeAllSessions(ctx, now)
+		close(done)
+	}()
 
-		if err := b.repository.AddVoiceSeconds(userID, guildID, durationSeconds); err != nil {
-			log.Printf("Error adding voice seconds: %v", err)
-		}
-		if err := b.repository.AddChannelSeconds(userID, guildID, channelID, durationSeconds); err != nil {
-			log.Printf("Error adding channel seconds: %v", err)
-		}
-		fmt.Printf("⬅️ Leave: %s (%s), +%d seconds channel=%s (%s)\n", 
-			username, userID, durationSeconds, channelID, channelName)
+	select {
+	case <-done:
+		fmt.Println("💾 Open sessions flushed")
+	case <-ctx.Done():
+		log.Printf("Timed out flushing open sessions after %s; remaining sessions will be recovered on next start", b.shutdownTimeout)
 	}
-}
+	b.cancel()
 
-// presenceUpdate handles presence updates for activity tracking
-func (b *Bot) presenceUpdate(s *discordgo.Session, p *discordgo.PresenceUpdate) {
-	guildID := p.GuildID
-	userID := p.User.ID
-	
-	// Get user info
-	user, err := s.User(userID)
-	username := userID
-	if err == nil && user != nil {
-		username = user.Username
-	}
-	
-	log.Printf("presenceUpdate: guild=%s user=%s (%s) activities=%d", guildID, userID, username, len(p.Activities))
-
-	// Collect relevant activity names (Game/Application)
-	activeSet := make(map[string]bool)
-	for _, act := range p.Activities {
-		name := act.Name
-		if name != "" {
-			activeSet[name] = true
-			log.Printf("activity on: %s (%s) | %s", username, userID, name)
-		}
-	}
-
-	// Close activities that were previously active but now inactive
-	for key, start := range b.activitySessions {
-		// key format: user:activity (global)
-		prefix := userID + ":"
-		if !strings.HasPrefix(key, prefix) {
-			continue
-		}
-		activityName := strings.TrimPrefix(key, prefix)
-		if !activeSet[activityName] {
-			// accumulate duration
-			seconds := int64(time.Since(start).Seconds())
-			delete(b.activitySessions, key)
-			if err := b.repository.AddActivitySeconds(userID, activityName, seconds); err != nil {
-				log.Printf("Error adding activity seconds: %v", err)
-			}
-			log.Printf("activity off: %s (%s) | %s +%ds", username, userID, activityName, seconds)
-		}
-	}
-
-	// Start new activities that haven't been recorded
-	for name := range activeSet {
-		key := userID + ":" + name
-		if b.activitySessions[key].IsZero() {
-			b.activitySessions[key] = time.Now().UTC()
-			log.Printf("activity start: %s (%s) | %s", username, userID, name)
-		}
-	}
+	return err
 }
 
 // messageCreate handles message creation events
@@ -180,33 +151,57 @@ func (b *Bot) messageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
 		return
 	}
 
+	ctx := b.ctx
 	content := strings.TrimSpace(m.Content)
 	botUserID := s.State.User.ID // ambil ID bot
 	isMentioned := strings.Contains(content, "<@"+botUserID+">") || strings.Contains(content, "<@!"+botUserID+">")
 
+	// Settings commands match the first token exactly, so "!ignoreX" is
+	// not taken for !ignore
+	var command string
+	if fields := strings.Fields(content); len(fields) > 0 {
+		command = fields[0]
+	}
+
 	switch {
 	case content == "!voice" || strings.HasPrefix(content, "!voicechan"):
-		b.handleVoiceCommand(s, m)
+		b.handleVoiceCommand(ctx, s, m)
 	case strings.HasPrefix(content, "!play"):
-		b.handlePlayCommand(s, m)
+		b.handlePlayCommand(ctx, s, m)
 	case isMentioned:
 		// Handle bot mention commands (music or stats)
-		b.handleMentionCommand(s, m)
+		b.handleMentionCommand(ctx, s, m)
 	case content == "!stats":
-		b.handleStatsCommand(s, m)
+		b.handleStatsCommand(ctx, s, m)
 	case strings.HasPrefix(content, "!leaderboard"):
-		b.handleLeaderboardCommand(s, m)
+		b.handleLeaderboardCommand(ctx, s, m)
 	case strings.HasPrefix(content, "!compare"):
-		b.handleCompareCommand(s, m)
+		b.handleCompareCommand(ctx, s, m)
 	case content == "!weekly":
-		b.handleWeeklyCommand(s, m)
+		b.handleWeeklyCommand(ctx, s, m)
 	case content == "!monthly":
-		b.handleMonthlyCommand(s, m)
+		b.handleMonthlyCommand(ctx, s, m)
+	case content == "!history":
+		b.handleHistoryCommand(ctx, s, m)
+	case command == "!timezone":
+		b.handleTimezoneCommand(ctx, s, m)
+	case command == "!ignore" || command == "!unignore":
+		b.handleIgnoreCommand(ctx, s, m)
+	case command == "!excludedeaf":
+		b.handleExcludeDeafCommand(ctx, s, m)
+	case command == "!minhumans":
+		b.handleMinHumansCommand(ctx, s, m)
+	case command == "!alias" || command == "!unalias":
+		b.handleAliasCommand(ctx, s, m)
+	case command == "!details":
+		b.handleDetailsCommand(ctx, s, m)
+	case command == "!music":
+		b.handleMusicTopCommand(ctx, s, m)
 	}
 }
 
 // handleMentionCommand handles bot mention commands
-func (b *Bot) handleMentionCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
+func (b *Bot) handleMentionCommand(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) {
 	content := strings.TrimSpace(m.Content)
 	
 	// Remove bot mention from content to get the actual command
@@ -218,7 +213,7 @@ func (b *Bot) handleMentionCommand(s *discordgo.Session, m *discordgo.MessageCre
 	// Check if it's a music-related command or just stats
 	if content == "" || strings.ToLower(content) == "stats" {
 		// Default to stats if no specific command or "stats"
-		b.handleStatsCommand(s, m)
+		b.handleStatsCommand(ctx, s, m)
 		return
 	}
 	
@@ -242,7 +237,7 @@ func (b *Bot) handleMentionCommand(s *discordgo.Session, m *discordgo.MessageCre
 	}
 	
 	// Default to stats for anything else
-	b.handleStatsCommand(s, m)
+	b.handleStatsCommand(ctx, s, m)
 }
 
 // isMusicQuery checks if the content looks like a music query
@@ -273,8 +268,8 @@ func (b *Bot) isMusicQuery(content string) bool {
 }
 
 // handleVoiceCommand handles the !voice command
-func (b *Bot) handleVoiceCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
-	channelHours, err := b.repository.GetVoiceChannelHours(m.Author.ID, m.GuildID)
+func (b *Bot) handleVoiceCommand(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) {
+	channelHours, err := b.repository.GetVoiceChannelHoursContext(ctx, m.Author.ID, m.GuildID)
 	if err != nil {
 		log.Printf("Error getting voice channel hours: %v", err)
 		s.ChannelMessageSend(m.ChannelID, "Terjadi kesalahan mengambil data voice per channel.")
@@ -287,7 +282,7 @@ func (b *Bot) handleVoiceCommand(s *discordgo.Session, m *discordgo.MessageCreat
 	}
 
 	// Get total overall
-	totalSeconds, err := b.repository.GetVoiceHours(m.Author.ID, m.GuildID)
+	totalSeconds, err := b.repository.GetVoiceHoursContext(ctx, m.Author.ID, m.GuildID)
 	if err != nil {
 		log.Printf("Error getting total voice hours: %v", err)
 	}
@@ -296,39 +291,115 @@ func (b *Bot) handleVoiceCommand(s *discordgo.Session, m *discordgo.MessageCreat
 		lines = append(lines, "(belum ada data per channel)")
 	}
 
+	// Time in AFK or ignored channels is kept out of the totals above
+	idleSeconds, err := b.repository.GetIdleHoursContext(ctx, m.Author.ID, m.GuildID)
+	if err != nil {
+		log.Printf("Error getting idle hours: %v", err)
+	}
+	if idleSeconds > 0 {
+		lines = append(lines, fmt.Sprintf("AFK/diabaikan/sendirian: %s", utils.FormatDuration(idleSeconds)))
+	}
+
 	msg := fmt.Sprintf("🔊 %s, voice per channel:\n%s\nTotal: %s", 
 		m.Author.Username, strings.Join(lines, "\n"), utils.FormatDuration(totalSeconds))
+	if breakdown := b.voiceBreakdown(ctx, m.Author.ID, m.GuildID, totalSeconds); breakdown != "" {
+		msg += "\n" + breakdown
+	}
 	s.ChannelMessageSend(m.ChannelID, msg)
 }
 
+// voiceBreakdown formats a user's voice time split into active, muted and
+// deafened time plus go-live and camera time, or "" if nothing is recorded
+func (b *Bot) voiceBreakdown(ctx context.Context, userID, guildID string, totalSeconds int64) string {
+	stats, err := b.repository.GetVoiceStateHoursContext(ctx, userID, guildID)
+	if err != nil {
+		log.Printf("Error getting voice state hours: %v", err)
+		return ""
+	}
+	if stats.MutedSeconds+stats.DeafenedSeconds+stats.StreamingSeconds+stats.VideoSeconds == 0 {
+		return ""
+	}
+
+	activeSeconds := totalSeconds - stats.MutedSeconds - stats.DeafenedSeconds
+	if activeSeconds < 0 {
+		activeSeconds = 0
+	}
+	return fmt.Sprintf("🎙️ Aktif: %s | 🔇 Mute: %s | 🙉 Deafen: %s\n📺 Live: %s | 📷 Kamera: %s",
+		utils.FormatDuration(activeSeconds), utils.FormatDuration(stats.MutedSeconds),
+		utils.FormatDuration(stats.DeafenedSeconds), utils.FormatDuration(stats.StreamingSeconds),
+		utils.FormatDuration(stats.VideoSeconds))
+}
+
+// activityTypeLabels are the !stats labels of the activity types, in display order
+var activityTypeLabels = []struct{ activityType, label string }{
+	{database.ActivityTypePlaying, "🎮 Bermain"},
+	{database.ActivityTypeStreaming, "📡 Streaming"},
+	{database.ActivityTypeListening, "🎧 Mendengarkan"},
+	{database.ActivityTypeWatching, "📺 Menonton"},
+	{database.ActivityTypeCompeting, "🏆 Bertanding"},
+	{database.ActivityTypeCustom, "💬 Custom status"},
+}
+
+// activityTypeBreakdown formats a user's activity time per activity type
+func (b *Bot) activityTypeBreakdown(ctx context.Context, userID string) string {
+	types, err := b.repository.GetActivityTypeHoursContext(ctx, userID)
+	if err != nil {
+		log.Printf("Error getting activity type hours: %v", err)
+		return ""
+	}
+
+	totals := make(map[string]int64)
+	for _, hours := range types {
+		totals[hours.ActivityType] = hours.TotalSeconds
+	}
+
+	var lines []string
+	for _, t := range activityTypeLabels {
+		if seconds := totals[t.activityType]; seconds > 0 {
+			lines = append(lines, fmt.Sprintf("- %s: %s", t.label, utils.FormatDuration(seconds)))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
 // handlePlayCommand handles the !play command
-func (b *Bot) handlePlayCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
+func (b *Bot) handlePlayCommand(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) {
 	content := strings.TrimSpace(m.Content)
-	name := strings.TrimSpace(strings.TrimPrefix(content, "!play"))
+	// The global totals are kept under the reported name, not the guild's aliases
+	name := utils.NormalizeActivityName(strings.TrimPrefix(content, "!play"))
 	if name == "" {
 		s.ChannelMessageSend(m.ChannelID, "Format: !play <nama game/aplikasi>")
 		return
 	}
 
-	totalSeconds, err := b.repository.GetActivityHours(m.Author.ID, name)
+	totalSeconds, err := b.repository.GetActivityHoursContext(ctx, m.Author.ID, name)
 	if err != nil {
 		log.Printf("Error getting activity hours: %v", err)
 	}
 
 	msg := fmt.Sprintf("🎮 %s, %s selama %s", m.Author.Username, name, utils.FormatDuration(totalSeconds))
+
+	// Time per mode/map for games whose rich presence details are tracked
+	details, err := b.repository.GetActivityDetailHoursContext(ctx, m.Author.ID, name, 5)
+	if err != nil {
+		log.Printf("Error getting activity detail hours: %v", err)
+	}
+	for _, detail := range details {
+		msg += fmt.Sprintf("\n- %s: %s", detail.Detail, utils.FormatDuration(detail.TotalSeconds))
+	}
 	s.ChannelMessageSend(m.ChannelID, msg)
 }
 
 // handleStatsCommand handles the !stats command
-func (b *Bot) handleStatsCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
+func (b *Bot) handleStatsCommand(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) {
 	// Get total voice hours for this guild
-	voiceSeconds, err := b.repository.GetVoiceHours(m.Author.ID, m.GuildID)
+	voiceSeconds, err := b.repository.GetVoiceHoursContext(ctx, m.Author.ID, m.GuildID)
 	if err != nil {
 		log.Printf("Error getting voice hours: %v", err)
 	}
 
 	// Get top activities
-	activities, err := b.repository.GetTopActivities(m.Author.ID, 5)
+	activities, err := b.repository.GetTopActivitiesContext(ctx, m.Author.ID, 5)
 	if err != nil {
 		log.Printf("Error getting top activities: %v", err)
 		s.ChannelMessageSend(m.ChannelID, "Terjadi kesalahan mengambil statistik.")
@@ -340,39 +411,57 @@ func (b *Bot) handleStatsCommand(s *discordgo.Session, m *discordgo.MessageCreat
 		lines = append(lines, fmt.Sprintf("- %s: %s", activity.ActivityName, utils.FormatDuration(activity.TotalSeconds)))
 	}
 
-	msg := fmt.Sprintf("📊 %s\nVoice (server ini): %s\nAktivitas teratas (global):\n%s", 
-		m.Author.Username, utils.FormatDuration(voiceSeconds), strings.Join(lines, "\n"))
+	voiceLine := utils.FormatDuration(voiceSeconds)
+	if breakdown := b.voiceBreakdown(ctx, m.Author.ID, m.GuildID, voiceSeconds); breakdown != "" {
+		voiceLine += "\n" + breakdown
+	}
+
+	msg := fmt.Sprintf("📊 %s\nVoice (server ini): %s", m.Author.Username, voiceLine)
+	if types := b.activityTypeBreakdown(ctx, m.Author.ID); types != "" {
+		msg += "\nAktivitas per jenis (global):\n" + types
+	}
+	msg += fmt.Sprintf("\nAktivitas teratas (global):\n%s", strings.Join(lines, "\n"))
 	s.ChannelMessageSend(m.ChannelID, msg)
 }
 
 // handleLeaderboardCommand handles the !leaderboard command
-func (b *Bot) handleLeaderboardCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
+func (b *Bot) handleLeaderboardCommand(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) {
 	content := strings.TrimSpace(m.Content)
 	parts := strings.Fields(content)
 	
 	if len(parts) < 2 {
-		s.ChannelMessageSend(m.ChannelID, "Format: !leaderboard voice | !leaderboard play <nama game>")
+		s.ChannelMessageSend(m.ChannelID, "Format: !leaderboard voice | !leaderboard play [global] <nama game>")
 		return
 	}
 	
 	switch parts[1] {
 	case "voice":
-		b.handleVoiceLeaderboard(s, m)
+		b.handleVoiceLeaderboard(ctx, s, m)
 	case "play":
+		// Server only by default, "global" for every server
+		global := len(parts) > 2 && strings.EqualFold(parts[2], "global")
+		if global {
+			parts = append(parts[:2], parts[3:]...)
+		}
 		if len(parts) < 3 {
-			s.ChannelMessageSend(m.ChannelID, "Format: !leaderboard play <nama game>")
+			s.ChannelMessageSend(m.ChannelID, "Format: !leaderboard play [global] <nama game>")
 			return
 		}
-		gameName := strings.Join(parts[2:], " ")
-		b.handleActivityLeaderboard(s, m, gameName)
+		// Guild aliases only apply to the guild's own totals
+		gameName := utils.NormalizeActivityName(strings.Join(parts[2:], " "))
+		if !global {
+			gameName = b.resolveActivityName(ctx, m.GuildID, gameName)
+		}
+		b.handleActivityLeaderboard(ctx, s, m, gameName, global)
 	default:
-		s.ChannelMessageSend(m.ChannelID, "Format: !leaderboard voice | !leaderboard play <nama game>")
+		s.ChannelMessageSend(m.ChannelID, "Format: !leaderboard voice | !leaderboard play [global] <nama game>")
 	}
 }
 
 // handleVoiceLeaderboard handles voice leaderboard
-func (b *Bot) handleVoiceLeaderboard(s *discordgo.Session, m *discordgo.MessageCreate) {
-	entries, err := b.repository.GetVoiceLeaderboard(m.GuildID, 10)
+func (b *Bot) handleVoiceLeaderboard(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) {
+	excludeDeafened := b.guildSettings(ctx, m.GuildID).ExcludeDeafened
+	entries, err := b.repository.GetVoiceLeaderboardContext(ctx, m.GuildID, 10, excludeDeafened)
 	if err != nil {
 		log.Printf("Error getting voice leaderboard: %v", err)
 		s.ChannelMessageSend(m.ChannelID, "Terjadi kesalahan mengambil leaderboard voice.")
@@ -391,13 +480,21 @@ func (b *Bot) handleVoiceLeaderboard(s *discordgo.Session, m *discordgo.MessageC
 		lines = append(lines, line)
 	}
 	
-	msg := fmt.Sprintf("🏆 **Voice Leaderboard** (Server ini)\n%s", strings.Join(lines, "\n"))
+	title := "🏆 **Voice Leaderboard** (Server ini)"
+	if excludeDeafened {
+		title += " - tanpa waktu deafen"
+	}
+	msg := fmt.Sprintf("%s\n%s", title, strings.Join(lines, "\n"))
 	s.ChannelMessageSend(m.ChannelID, msg)
 }
 
 // handleActivityLeaderboard handles activity leaderboard
-func (b *Bot) handleActivityLeaderboard(s *discordgo.Session, m *discordgo.MessageCreate, activityName string) {
-	entries, err := b.repository.GetActivityLeaderboard(activityName, 10)
+func (b *Bot) handleActivityLeaderboard(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate, activityName string, global bool) {
+	guildID, scope := m.GuildID, "Server ini"
+	if global {
+		guildID, scope = "", "Global"
+	}
+	entries, err := b.repository.GetActivityLeaderboardContext(ctx, guildID, activityName, 10)
 	if err != nil {
 		log.Printf("Error getting activity leaderboard: %v", err)
 		s.ChannelMessageSend(m.ChannelID, "Terjadi kesalahan mengambil leaderboard aktivitas.")
@@ -416,12 +513,12 @@ func (b *Bot) handleActivityLeaderboard(s *discordgo.Session, m *discordgo.Messa
 		lines = append(lines, line)
 	}
 	
-	msg := fmt.Sprintf("🎮 **Leaderboard %s** (Global)\n%s", activityName, strings.Join(lines, "\n"))
+	msg := fmt.Sprintf("🎮 **Leaderboard %s** (%s)\n%s", activityName, scope, strings.Join(lines, "\n"))
 	s.ChannelMessageSend(m.ChannelID, msg)
 }
 
 // handleCompareCommand handles the !compare command
-func (b *Bot) handleCompareCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
+func (b *Bot) handleCompareCommand(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) {
 	content := strings.TrimSpace(m.Content)
 	parts := strings.Fields(content)
 	
@@ -441,7 +538,7 @@ func (b *Bot) handleCompareCommand(s *discordgo.Session, m *discordgo.MessageCre
 	userID1 := utils.ExtractUserIDFromMention(user1Mention)
 	userID2 := utils.ExtractUserIDFromMention(user2Mention)
 	
-	comparisons, err := b.repository.GetUserComparison(userID1, userID2, m.GuildID)
+	comparisons, err := b.repository.GetUserComparisonContext(ctx, userID1, userID2, m.GuildID)
 	if err != nil {
 		log.Printf("Error getting user comparison: %v", err)
 		s.ChannelMessageSend(m.ChannelID, "Terjadi kesalahan mengambil data perbandingan.")
@@ -470,12 +567,12 @@ func (b *Bot) handleCompareCommand(s *discordgo.Session, m *discordgo.MessageCre
 }
 
 // handleWeeklyCommand handles the !weekly command
-func (b *Bot) handleWeeklyCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
-	// Get current week start (Monday)
-	now := time.Now()
-	weekStart := now.AddDate(0, 0, -int(now.Weekday())+1).Format("2006-01-02")
+func (b *Bot) handleWeeklyCommand(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) {
+	// Get current week start (Monday) in the user's timezone
+	loc := b.location(ctx, m.GuildID, m.Author.ID)
+	weekStart := utils.FormatDate(utils.WeekStart(time.Now(), loc), loc)
 	
-	stats, err := b.repository.GetWeeklyReport(m.Author.ID, m.GuildID, weekStart)
+	stats, err := b.repository.GetWeeklyReportContext(ctx, m.Author.ID, m.GuildID, weekStart)
 	if err != nil {
 		log.Printf("Error getting weekly report: %v", err)
 		s.ChannelMessageSend(m.ChannelID, "Terjadi kesalahan mengambil laporan mingguan.")
@@ -508,8 +605,12 @@ func (b *Bot) handleWeeklyCommand(s *discordgo.Session, m *discordgo.MessageCrea
 }
 
 // handleMonthlyCommand handles the !monthly command
-func (b *Bot) handleMonthlyCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
-	stats, err := b.repository.GetMonthlyReport(m.Author.ID, m.GuildID)
+func (b *Bot) handleMonthlyCommand(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) {
+	// Last 4 weeks, including the current one, in the user's timezone
+	loc := b.location(ctx, m.GuildID, m.Author.ID)
+	since := utils.FormatDate(utils.WeekStart(time.Now(), loc).AddDate(0, 0, -21), loc)
+
+	stats, err := b.repository.GetMonthlyReportContext(ctx, m.Author.ID, m.GuildID, since)
 	if err != nil {
 		log.Printf("Error getting monthly report: %v", err)
 		s.ChannelMessageSend(m.ChannelID, "Terjadi kesalahan mengambil laporan bulanan.")
@@ -557,6 +658,85 @@ func (b *Bot) handleMonthlyCommand(s *discordgo.Session, m *discordgo.MessageCre
 	s.ChannelMessageSend(m.ChannelID, msg)
 }
 
+// handleHistoryCommand handles the !history command
+func (b *Bot) handleHistoryCommand(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) {
+	entries, err := b.repository.GetRecentSessionLogsContext(ctx, m.Author.ID, m.GuildID, 10)
+	if err != nil {
+		log.Printf("Error getting session logs: %v", err)
+		s.ChannelMessageSend(m.ChannelID, "Terjadi kesalahan mengambil riwayat sesi.")
+		return
+	}
+
+	if len(entries) == 0 {
+		s.ChannelMessageSend(m.ChannelID, "Belum ada riwayat sesi.")
+		return
+	}
+
+	loc := b.location(ctx, m.GuildID, m.Author.ID)
+	var lines []string
+	for _, entry := range entries {
+		subject := entry.Subject
+		if entry.Kind == database.SessionKindVoice {
+			subject = "🔊 " + b.channelName(s, entry.Subject)
+			if entry.Idle {
+				subject += " (idle)"
+			}
+		} else {
+			subject = "🎮 " + subject
+		}
+		seconds := int64(entry.EndedAt.Sub(entry.StartedAt).Seconds())
+		lines = append(lines, fmt.Sprintf("%s - %s %s: %s",
+			entry.StartedAt.In(loc).Format("02 Jan 15:04"), entry.EndedAt.In(loc).Format("15:04"),
+			subject, utils.FormatDuration(seconds)))
+	}
+
+	msg := fmt.Sprintf("🕒 **Riwayat Sesi** %s\n%s", m.Author.Username, strings.Join(lines, "\n"))
+	s.ChannelMessageSend(m.ChannelID, msg)
+}
+
+// handleMusicTopCommand handles the !music top command, showing the most
+// listened Spotify artists and tracks of the user or of the server
+func (b *Bot) handleMusicTopCommand(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) {
+	parts := strings.Fields(strings.TrimSpace(m.Content))
+	if len(parts) < 2 || parts[1] != "top" || len(parts) > 3 || (len(parts) == 3 && parts[2] != "server") {
+		s.ChannelMessageSend(m.ChannelID, "Format: !music top | !music top server")
+		return
+	}
+
+	userID, title := m.Author.ID, fmt.Sprintf("🎧 **Spotify teratas** - %s", m.Author.Username)
+	if len(parts) == 3 {
+		userID, title = "", "🎧 **Spotify teratas** (Server ini)"
+	}
+
+	artists, err := b.repository.GetTopArtistsContext(ctx, userID, m.GuildID, 5)
+	if err != nil {
+		log.Printf("Error getting top artists: %v", err)
+		s.ChannelMessageSend(m.ChannelID, "Terjadi kesalahan mengambil statistik musik.")
+		return
+	}
+	tracks, err := b.repository.GetTopTracksContext(ctx, userID, m.GuildID, 5)
+	if err != nil {
+		log.Printf("Error getting top tracks: %v", err)
+		s.ChannelMessageSend(m.ChannelID, "Terjadi kesalahan mengambil statistik musik.")
+		return
+	}
+
+	if len(artists) == 0 {
+		s.ChannelMessageSend(m.ChannelID, "Belum ada riwayat Spotify.")
+		return
+	}
+
+	lines := []string{title, "Artis:"}
+	for i, artist := range artists {
+		lines = append(lines, fmt.Sprintf("%d. %s - %s", i+1, artist.Artist, utils.FormatDuration(artist.TotalSeconds)))
+	}
+	lines = append(lines, "Lagu:")
+	for i, track := range tracks {
+		lines = append(lines, fmt.Sprintf("%d. %s (%s) - %s", i+1, track.Track, track.Artist, utils.FormatDuration(track.TotalSeconds)))
+	}
+	s.ChannelMessageSend(m.ChannelID, strings.Join(lines, "\n"))
+}
+
 // formatTopActivities formats top activities for display
 func (b *Bot) formatTopActivities(activities []database.ActivityHours) string {
 	if len(activities) == 0 {
@@ -0,0 +1,477 @@
+package discord
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+
+	"playstats/internal/config"
+	"playstats/internal/database"
+	"playstats/internal/models"
+)
+
+// fakeDiscord answers the Discord REST API in tests, recording the messages
+// the bot sends and reporting everything else as not found
+type fakeDiscord struct {
+	mu       sync.Mutex
+	messages []string
+	gets     int
+}
+
+func (f *fakeDiscord) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodGet {
+		f.mu.Lock()
+		f.gets++
+		f.mu.Unlock()
+	}
+	if req.Method == http.MethodPost && strings.HasSuffix(req.URL.Path, "/messages") {
+		var message struct {
+			Content string `json:"content"`
+		}
+		json.NewDecoder(req.Body).Decode(&message)
+		f.mu.Lock()
+		f.messages = append(f.messages, message.Content)
+		f.mu.Unlock()
+		return response(http.StatusOK, `{"id":"1"}`), nil
+	}
+	return response(http.StatusNotFound, `{"message":"Unknown","code":0}`), nil
+}
+
+// sent returns the messages the bot has sent so far
+func (f *fakeDiscord) sent() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.messages...)
+}
+
+// lookups returns how many GET requests the bot has made so far
+func (f *fakeDiscord) lookups() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.gets
+}
+
+func response(status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(bytes.NewBufferString(body)),
+	}
+}
+
+// newTestBot creates a bot backed by a MemoryStore that talks to a fake
+// Discord API instead of the network
+func newTestBot(t *testing.T, cfg *config.Config) (*Bot, *database.MemoryStore, *fakeDiscord) {
+	t.Helper()
+	store := database.NewMemoryStore()
+	bot, fake := newTestBotWithStore(t, cfg, store)
+	return bot, store, fake
+}
+
+// newTestBotWithStore is like newTestBot but uses the given store
+func newTestBotWithStore(t *testing.T, cfg *config.Config, store database.Store) (*Bot, *fakeDiscord) {
+	t.Helper()
+	if cfg == nil {
+		cfg = &config.Config{}
+	}
+	cfg.DiscordToken = "test"
+	if cfg.DefaultTimezone == nil {
+		cfg.DefaultTimezone = time.UTC
+	}
+	if cfg.ShutdownTimeout == 0 {
+		cfg.ShutdownTimeout = time.Second
+	}
+
+	bot, err := New(cfg, store)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	fake := &fakeDiscord{}
+	bot.session.Client = &http.Client{Transport: fake}
+	bot.session.MaxRestRetries = 0
+	bot.session.State.User = &discordgo.User{ID: "bot"}
+	t.Cleanup(bot.cancel)
+	return bot, fake
+}
+
+// send delivers a chat message from a user to the bot
+func send(bot *Bot, userID, content string) {
+	bot.messageCreate(bot.session, &discordgo.MessageCreate{Message: &discordgo.Message{
+		ChannelID: "text",
+		GuildID:   "g1",
+		Content:   content,
+		Author:    &discordgo.User{ID: userID, Username: userID},
+	}})
+}
+
+func TestPlayCommand(t *testing.T) {
+	bot, store, fake := newTestBot(t, nil)
+	ctx := context.Background()
+	store.AddActivitySecondsContext(ctx, "u1", "Valorant", 3600)
+	store.AddActivityDetailSecondsContext(ctx, "u1", "Valorant", "Competitive - Ascent", 1800)
+
+	send(bot, "u1", "!play VALORANT")
+
+	sent := fake.sent()
+	if len(sent) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(sent))
+	}
+	for _, want := range []string{"VALORANT selama 1:00:00", "- Competitive - Ascent: 0:30:00"} {
+		if !strings.Contains(sent[0], want) {
+			t.Errorf("reply %q does not contain %q", sent[0], want)
+		}
+	}
+}
+
+func TestStatsCommand(t *testing.T) {
+	bot, store, fake := newTestBot(t, nil)
+	ctx := context.Background()
+	store.AddVoiceSecondsContext(ctx, "u1", "g1", 7200)
+	store.AddActivitySecondsContext(ctx, "u1", "Minecraft", 600)
+
+	send(bot, "u1", "!stats")
+
+	sent := fake.sent()
+	if len(sent) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(sent))
+	}
+	for _, want := range []string{"Voice (server ini): 2:00:00", "- Minecraft: 0:10:00"} {
+		if !strings.Contains(sent[0], want) {
+			t.Errorf("reply %q does not contain %q", sent[0], want)
+		}
+	}
+}
+
+func TestUnknownSettingsCommandIgnored(t *testing.T) {
+	bot, _, fake := newTestBot(t, nil)
+
+	send(bot, "u1", "!ignoreX #general")
+	send(bot, "u1", "!aliasfoo")
+
+	if sent := fake.sent(); len(sent) != 0 {
+		t.Errorf("sent %q, want no replies", sent)
+	}
+}
+
+func TestVoiceSessionCredited(t *testing.T) {
+	bot, store, _ := newTestBot(t, nil)
+	ctx := context.Background()
+	start := time.Date(2026, 1, 5, 10, 0, 0, 0, time.UTC)
+
+	bot.trackingMu.Lock()
+	bot.openVoiceSession(ctx, "g1:u1", "u1", "g1", "c1", voiceFlags(&discordgo.VoiceState{}), true, start)
+	seconds := bot.closeVoiceSession(ctx, "g1:u1", "u1", "g1", start.Add(90*time.Minute))
+	bot.trackingMu.Unlock()
+	bot.runStoreQueue()
+
+	if seconds != 5400 {
+		t.Errorf("closeVoiceSession = %d, want 5400", seconds)
+	}
+	if total, _ := store.GetVoiceHoursContext(ctx, "u1", "g1"); total != 5400 {
+		t.Errorf("voice hours = %d, want 5400", total)
+	}
+	channels, _ := store.GetVoiceChannelHoursContext(ctx, "u1", "g1")
+	if len(channels) != 1 || channels[0].ChannelID != "c1" || channels[0].TotalSeconds != 5400 {
+		t.Errorf("channel hours = %+v, want c1 with 5400", channels)
+	}
+}
+
+func TestActivitySessionCredited(t *testing.T) {
+	bot, store, _ := newTestBot(t, nil)
+	ctx := context.Background()
+	start := time.Date(2026, 1, 5, 10, 0, 0, 0, time.UTC)
+
+	bot.trackingMu.Lock()
+	bot.openActivitySession(ctx, "u1", "g1", "Valorant", "Valorant", database.ActivityTypePlaying, start)
+	bot.closeActivitySession(ctx, "u1", "Valorant", start.Add(time.Hour))
+	bot.trackingMu.Unlock()
+	bot.runStoreQueue()
+
+	if total, _ := store.GetActivityHoursContext(ctx, "u1", "valorant"); total != 3600 {
+		t.Errorf("activity hours = %d, want 3600", total)
+	}
+	leaderboard, _ := store.GetActivityLeaderboardContext(ctx, "g1", "Valorant", 10)
+	if len(leaderboard) != 1 || leaderboard[0].TotalSeconds != 3600 {
+		t.Errorf("guild leaderboard = %+v, want u1 with 3600", leaderboard)
+	}
+	if logs, _ := store.GetRecentSessionLogsContext(ctx, "u1", "g1", 10); len(logs) != 1 {
+		t.Errorf("session logs = %+v, want 1", logs)
+	}
+}
+
+func TestActivityBelowMinimumDiscarded(t *testing.T) {
+	bot, store, _ := newTestBot(t, &config.Config{ActivityMinDuration: time.Minute})
+	ctx := context.Background()
+	start := time.Date(2026, 1, 5, 10, 0, 0, 0, time.UTC)
+
+	bot.trackingMu.Lock()
+	bot.openActivitySession(ctx, "u1", "g1", "Valorant", "Valorant", database.ActivityTypePlaying, start)
+	bot.closeActivitySession(ctx, "u1", "Valorant", start.Add(30*time.Second))
+	bot.trackingMu.Unlock()
+	bot.runStoreQueue()
+
+	if total, _ := store.GetActivityHoursContext(ctx, "u1", "Valorant"); total != 0 {
+		t.Errorf("activity hours = %d, want 0", total)
+	}
+}
+
+func TestShortActivityDetailAndTrackDiscarded(t *testing.T) {
+	bot, store, _ := newTestBot(t, &config.Config{ActivityMinDuration: time.Minute})
+	ctx := context.Background()
+	start := time.Date(2026, 1, 5, 10, 0, 0, 0, time.UTC)
+
+	bot.trackingMu.Lock()
+	bot.openActivitySession(ctx, "u1", "g1", "Valorant", "Valorant", database.ActivityTypePlaying, start)
+	session := bot.activitySessions["u1:Valorant"]
+	bot.playDetail(ctx, "u1", "Valorant", &session, "Competitive - Ascent", start)
+	bot.playTrack(ctx, "u1", &session, models.TrackPlay{Title: "Song", Artist: "Artist"}, start)
+	bot.playDetail(ctx, "u1", "Valorant", &session, "Unrated - Bind", start.Add(20*time.Second))
+	bot.activitySessions["u1:Valorant"] = session
+	bot.closeActivitySession(ctx, "u1", "Valorant", start.Add(30*time.Second))
+	bot.trackingMu.Unlock()
+	bot.runStoreQueue()
+
+	if details, _ := store.GetActivityDetailHoursContext(ctx, "u1", "Valorant", 5); len(details) != 0 {
+		t.Errorf("detail hours = %+v, want none", details)
+	}
+	if tracks, _ := store.GetTopTracksContext(ctx, "u1", "", 5); len(tracks) != 0 {
+		t.Errorf("track hours = %+v, want none", tracks)
+	}
+}
+
+func TestResumedActivityReplacesRecoveredRow(t *testing.T) {
+	bot, store, _ := newTestBot(t, nil)
+	ctx := context.Background()
+	start := time.Date(2026, 1, 5, 10, 0, 0, 0, time.UTC)
+	now := start.Add(time.Hour)
+	store.SaveOpenSessionContext(ctx, database.OpenSession{
+		Kind:          database.SessionKindActivity,
+		UserID:        "u1",
+		GuildID:       "g1",
+		Subject:       "Valorant",
+		StartedAt:     start,
+		CreditedUntil: now,
+		LastSeen:      now,
+	})
+	bot.recoverOpenSessions(ctx)
+
+	bot.trackingMu.Lock()
+	bot.openActivitySession(ctx, "u1", "g2", "Valorant", "Valorant", database.ActivityTypePlaying, now.Add(time.Minute))
+	bot.trackingMu.Unlock()
+	bot.runStoreQueue()
+
+	sessions, _ := store.GetOpenSessionsContext(ctx)
+	if len(sessions) != 1 || sessions[0].GuildID != "g2" || !sessions[0].StartedAt.Equal(start) {
+		t.Errorf("open sessions = %+v, want the resumed session under g2 only", sessions)
+	}
+}
+
+func TestGuildAliasesOnlyRenameGuildTotals(t *testing.T) {
+	bot, store, _ := newTestBot(t, nil)
+	ctx := context.Background()
+	store.SaveActivityAliasContext(ctx, database.ActivityAlias{GuildID: "g1", Alias: "valorant (beta)", ActivityName: "Valorant"})
+	playing := []*discordgo.Activity{{Name: "Valorant (Beta)", Type: discordgo.ActivityTypeGame}}
+
+	bot.trackPresence(ctx, bot.session, "g1", "u1", playing)
+	bot.trackPresence(ctx, bot.session, "g2", "u1", playing)
+
+	bot.trackingMu.Lock()
+	if len(bot.activitySessions) != 1 {
+		t.Errorf("activity sessions = %v, want one shared by both guilds", bot.activitySessions)
+	}
+	start := bot.activitySessions["u1:Valorant (Beta)"].Start
+	bot.closeActivitySession(ctx, "u1", "Valorant (Beta)", start.Add(time.Hour))
+	bot.trackingMu.Unlock()
+	bot.runStoreQueue()
+
+	if total, _ := store.GetActivityHoursContext(ctx, "u1", "Valorant (Beta)"); total != 3600 {
+		t.Errorf("activity hours = %d, want 3600", total)
+	}
+	if total, _ := store.GetActivityHoursContext(ctx, "u1", "Valorant"); total != 0 {
+		t.Errorf("aliased activity hours = %d, want 0", total)
+	}
+	if leaderboard, _ := store.GetActivityLeaderboardContext(ctx, "g1", "Valorant", 10); len(leaderboard) != 1 {
+		t.Errorf("g1 leaderboard = %+v, want u1 under the alias", leaderboard)
+	}
+	if leaderboard, _ := store.GetActivityLeaderboardContext(ctx, "g2", "Valorant (Beta)", 10); len(leaderboard) != 1 {
+		t.Errorf("g2 leaderboard = %+v, want u1 under the reported name", leaderboard)
+	}
+}
+
+func TestPlayCommandWithGuildAlias(t *testing.T) {
+	bot, store, fake := newTestBot(t, nil)
+	ctx := context.Background()
+	store.SaveActivityAliasContext(ctx, database.ActivityAlias{GuildID: "g1", Alias: "valorant (beta)", ActivityName: "Valorant"})
+
+	bot.trackPresence(ctx, bot.session, "g1", "u1", []*discordgo.Activity{{Name: "Valorant (Beta)", Type: discordgo.ActivityTypeGame}})
+	bot.trackingMu.Lock()
+	start := bot.activitySessions["u1:Valorant (Beta)"].Start
+	bot.closeActivitySession(ctx, "u1", "Valorant (Beta)", start.Add(time.Hour))
+	bot.trackingMu.Unlock()
+	bot.runStoreQueue()
+
+	send(bot, "u1", "!play Valorant (Beta)")
+
+	sent := fake.sent()
+	if len(sent) != 1 || !strings.Contains(sent[0], "Valorant (Beta) selama 1:00:00") {
+		t.Errorf("sent %q, want the hour played under the reported name", sent)
+	}
+}
+
+func TestActivityGapCreditedToReturningGuild(t *testing.T) {
+	bot, store, _ := newTestBot(t, &config.Config{ActivityGracePeriod: 5 * time.Minute})
+	ctx := context.Background()
+	now := time.Now().UTC()
+	start := now.Add(-time.Hour)
+
+	bot.trackingMu.Lock()
+	bot.openActivitySession(ctx, "u1", "g1", "Valorant", "Valorant", database.ActivityTypePlaying, start)
+	bot.removeActivityGuild(ctx, "u1", "Valorant", "g1", now.Add(-2*time.Minute))
+	bot.trackingMu.Unlock()
+	bot.runStoreQueue()
+
+	bot.trackPresence(ctx, bot.session, "g2", "u1", []*discordgo.Activity{{Name: "Valorant", Type: discordgo.ActivityTypeGame}})
+
+	bot.trackingMu.Lock()
+	bot.closeActivitySession(ctx, "u1", "Valorant", now.Add(time.Hour))
+	bot.trackingMu.Unlock()
+	bot.runStoreQueue()
+
+	total, _ := store.GetActivityHoursContext(ctx, "u1", "Valorant")
+	var guildTotal int64
+	for _, guildID := range []string{"g1", "g2"} {
+		leaderboard, _ := store.GetActivityLeaderboardContext(ctx, guildID, "Valorant", 10)
+		for _, entry := range leaderboard {
+			guildTotal += entry.TotalSeconds
+		}
+	}
+	if total != 7200 || guildTotal != total {
+		t.Errorf("activity hours = %d, guild totals = %d, want 7200 for both", total, guildTotal)
+	}
+}
+
+func TestRecoveredActivityClosedWhenItEnded(t *testing.T) {
+	bot, store, _ := newTestBot(t, nil)
+	ctx := context.Background()
+	start := time.Date(2026, 1, 5, 10, 0, 0, 0, time.UTC)
+	store.SaveOpenSessionContext(ctx, database.OpenSession{
+		Kind:          database.SessionKindActivity,
+		UserID:        "u1",
+		GuildID:       "g1",
+		Subject:       "Valorant",
+		StartedAt:     start,
+		CreditedUntil: start,
+		LastSeen:      start.Add(time.Hour),
+		Ended:         start.Add(30 * time.Minute),
+	})
+	bot.recoverOpenSessions(ctx)
+
+	bot.closeRecoveredSessions(ctx, func(database.OpenSession) bool { return true })
+
+	if total, _ := store.GetActivityHoursContext(ctx, "u1", "Valorant"); total != 1800 {
+		t.Errorf("activity hours = %d, want 1800", total)
+	}
+}
+
+func TestHeartbeatSkipsRecoveredSessions(t *testing.T) {
+	bot, store, _ := newTestBot(t, nil)
+	ctx := context.Background()
+	now := time.Now().UTC()
+	lastSeen := now.Add(-time.Hour)
+	store.SaveOpenSessionContext(ctx, database.OpenSession{
+		Kind:          database.SessionKindActivity,
+		UserID:        "u1",
+		GuildID:       "g1",
+		Subject:       "Valorant",
+		StartedAt:     lastSeen,
+		CreditedUntil: lastSeen,
+		LastSeen:      lastSeen,
+		RunID:         "previous",
+	})
+	bot.recoverOpenSessions(ctx)
+
+	bot.trackingMu.Lock()
+	bot.openActivitySession(ctx, "u2", "g1", "Minecraft", "Minecraft", database.ActivityTypePlaying, now)
+	bot.trackingMu.Unlock()
+	bot.runStoreQueue()
+	store.TouchOpenSessionsContext(ctx, bot.runID, now.Add(time.Minute))
+
+	sessions, _ := store.GetOpenSessionsContext(ctx)
+	for _, session := range sessions {
+		want := now.Add(time.Minute)
+		if session.UserID == "u1" {
+			want = lastSeen
+		}
+		if !session.LastSeen.Equal(want) {
+			t.Errorf("%s session last seen = %s, want %s", session.UserID, session.LastSeen, want)
+		}
+	}
+	if len(sessions) != 2 {
+		t.Errorf("open sessions = %+v, want 2", sessions)
+	}
+}
+
+// contextStore fails voice writes made with a cancelled context, like the
+// repository does
+type contextStore struct {
+	*database.MemoryStore
+}
+
+func (s contextStore) AddVoiceSecondsContext(ctx context.Context, userID, guildID string, seconds int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.MemoryStore.AddVoiceSecondsContext(ctx, userID, guildID, seconds)
+}
+
+func TestStopWritesQueuedWork(t *testing.T) {
+	store := contextStore{database.NewMemoryStore()}
+	bot, _ := newTestBotWithStore(t, nil, store)
+	ctx := context.Background()
+	start := time.Now().UTC().Add(-time.Hour)
+
+	// A checkpoint whose queued writes have not run yet when Stop is called
+	bot.trackingMu.Lock()
+	bot.openVoiceSession(bot.ctx, "g1:u1", "u1", "g1", "c1", voiceFlags(&discordgo.VoiceState{}), true, start)
+	bot.settleVoiceSession(bot.ctx, "g1:u1", "u1", "g1", start.Add(30*time.Minute))
+	bot.trackingMu.Unlock()
+
+	bot.Stop()
+
+	if total, _ := store.GetVoiceHoursContext(ctx, "u1", "g1"); total < 3599 {
+		t.Errorf("voice hours = %d, want the full hour", total)
+	}
+}
+
+func TestStopReturnsAfterTimeout(t *testing.T) {
+	store := &blockingStore{
+		MemoryStore: database.NewMemoryStore(),
+		saving:      make(chan struct{}, 1),
+		release:     make(chan struct{}),
+	}
+	bot, _ := newTestBotWithStore(t, &config.Config{ShutdownTimeout: 50 * time.Millisecond}, store)
+	defer close(store.release)
+
+	bot.trackingMu.Lock()
+	bot.openVoiceSession(bot.ctx, "g1:u1", "u1", "g1", "c1", voiceFlags(&discordgo.VoiceState{}), true, time.Now().UTC())
+	bot.trackingMu.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		bot.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("Stop is still waiting on a blocked store after the shutdown timeout")
+	}
+}
@@ -41,14 +41,12 @@ type MusicSession struct {
 	Queue     *MusicQueue
 	VoiceConn *discordgo.VoiceConnection
 	LastError error
+	Stop      chan struct{} // closed to interrupt the current stream
 }
 
 // YouTube client
 var ytClient = youtube.Client{}
 
-// Music sessions per guild
-var musicSessions = make(map[string]*MusicSession)
-
 // handleMusicCommand handles music commands with bot mention
 func (b *Bot) handleMusicCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
 	content := strings.TrimSpace(m.Content)
@@ -123,8 +121,11 @@ func (b *Bot) handlePlayMusic(s *discordgo.Session, m *discordgo.MessageCreate,
 	track.Requester = m.Author.Username
 	track.ChannelID = m.ChannelID
 
+	b.musicMu.Lock()
 	session := b.getOrCreateMusicSession(m.GuildID)
 	session.Queue.Tracks = append(session.Queue.Tracks, *track)
+	connected := session.VoiceConn != nil && session.VoiceConn.Ready
+	b.musicMu.Unlock()
 
 	embed := &discordgo.MessageEmbed{
 		Title: "🎵 Ditambahkan ke Queue",
@@ -138,14 +139,20 @@ func (b *Bot) handlePlayMusic(s *discordgo.Session, m *discordgo.MessageCreate,
 	}
 	s.ChannelMessageEditEmbed(m.ChannelID, loadingMsg.ID, embed)
 
-	if session.VoiceConn == nil || !session.VoiceConn.Ready {
+	if !connected {
 		if err := b.connectToVoice(s, m.GuildID, channelID); err != nil {
 			s.ChannelMessageSend(m.ChannelID, "❌ Gagal bergabung ke voice channel: "+err.Error())
 			return
 		}
 	}
 
-	if !session.Queue.IsPlaying {
+	// Mark the queue as playing before starting the player so concurrent
+	// requests don't start a second one
+	b.musicMu.Lock()
+	start := !session.Queue.IsPlaying
+	session.Queue.IsPlaying = true
+	b.musicMu.Unlock()
+	if start {
 		go b.startMusicPlayer(s, m.GuildID)
 	}
 }
@@ -256,9 +263,10 @@ func (b *Bot) searchYouTube(_ string) (*MusicTrack, error) {
 	return nil, fmt.Errorf("fitur pencarian YouTube belum tersedia. silakan gunakan URL YouTube langsung atau gunakan format: `@bot https://youtube.com/watch?v=VIDEO_ID`")
 }
 
-// getOrCreateMusicSession gets or creates a music session for a guild
+// getOrCreateMusicSession gets or creates a music session for a guild. The
+// caller must hold musicMu.
 func (b *Bot) getOrCreateMusicSession(guildID string) *MusicSession {
-	session, exists := musicSessions[guildID]
+	session, exists := b.musicSessions[guildID]
 	if !exists {
 		session = &MusicSession{
 			Queue: &MusicQueue{
@@ -269,7 +277,7 @@ func (b *Bot) getOrCreateMusicSession(guildID string) *MusicSession {
 				Volume:    0.5,
 			},
 		}
-		musicSessions[guildID] = session
+		b.musicSessions[guildID] = session
 	}
 	return session
 }
@@ -296,21 +304,35 @@ func (b *Bot) connectToVoice(s *discordgo.Session, guildID, channelID string) er
 		case <-ticker.C:
 			if voiceConn.Ready {
 				fmt.Printf("✅ Voice connection ready\n")
-				session := b.getOrCreateMusicSession(guildID)
-				session.VoiceConn = voiceConn
+				b.musicMu.Lock()
+				b.getOrCreateMusicSession(guildID).VoiceConn = voiceConn
+				b.musicMu.Unlock()
 				return nil
 			}
 		}
 	}
 }
 
-// startMusicPlayer starts the music player for a guild
+// startMusicPlayer plays a guild's queue until it ends or playback is
+// stopped. The queue must already be marked as playing.
 func (b *Bot) startMusicPlayer(s *discordgo.Session, guildID string) {
+	b.musicMu.Lock()
 	session := b.getOrCreateMusicSession(guildID)
-	session.Queue.IsPlaying = true
+	session.Stop = make(chan struct{})
+	stop := session.Stop
+	b.musicMu.Unlock()
 
-	for session.Queue.Current < len(session.Queue.Tracks) {
+	for {
+		b.musicMu.Lock()
+		if !session.Queue.IsPlaying || session.Queue.Current >= len(session.Queue.Tracks) {
+			session.Queue.IsPlaying = false
+			session.Queue.Current = 0
+			b.musicMu.Unlock()
+			return
+		}
 		track := session.Queue.Tracks[session.Queue.Current]
+		voiceConn := session.VoiceConn
+		b.musicMu.Unlock()
 
 		embed := &discordgo.MessageEmbed{
 			Title: "🎵 Now Playing",
@@ -324,24 +346,30 @@ func (b *Bot) startMusicPlayer(s *discordgo.Session, guildID string) {
 		}
 		s.ChannelMessageSendEmbed(track.ChannelID, embed)
 
-		err := b.playAudioStream(session.VoiceConn, track.URL)
+		err := b.playAudioStream(voiceConn, track.URL, stop)
 		if err != nil {
 			log.Printf("Gagal stream audio: %v", err)
 			s.ChannelMessageSend(track.ChannelID, fmt.Sprintf("❌ Gagal memutar lagu: %v", err))
 		}
 
+		b.musicMu.Lock()
+		// Stopped while streaming; stopMusic already reset the queue and a
+		// new player may own it now
+		if session.Stop != stop {
+			b.musicMu.Unlock()
+			return
+		}
 		session.Queue.Current++
 		if session.Queue.Current >= len(session.Queue.Tracks) && session.Queue.Loop {
 			session.Queue.Current = 0
 		}
+		b.musicMu.Unlock()
 	}
-
-	session.Queue.IsPlaying = false
-	session.Queue.Current = 0
 }
 
 // playAudioStream streams audio using PCM encoding and layeh/gopus Opus encoder
-func (b *Bot) playAudioStream(vc *discordgo.VoiceConnection, url string) error {
+// until the track ends or stop is closed
+func (b *Bot) playAudioStream(vc *discordgo.VoiceConnection, url string, stop <-chan struct{}) error {
     fmt.Printf("🎵 Starting audio stream for: %s\n", url)
 
     if vc == nil || !vc.Ready {
@@ -400,7 +428,11 @@ func (b *Bot) playAudioStream(vc *discordgo.VoiceConnection, url string) error {
         return fmt.Errorf("gagal mulai ffmpeg: %v", err)
     }
 
-    defer cmd.Wait()
+    defer func() {
+        // Make sure ffmpeg exits if we stop reading before the end
+        cmd.Process.Kill()
+        cmd.Wait()
+    }()
 
     // Buat encoder Opus
     opusEncoder, err := gopus.NewEncoder(48000, 2, gopus.Audio)
@@ -438,6 +470,9 @@ func (b *Bot) playAudioStream(vc *discordgo.VoiceConnection, url string) error {
 
         select {
         case vc.OpusSend <- opusFrame:
+        case <-stop:
+            fmt.Println("⏹️ Audio stream stopped")
+            return nil
         case <-time.After(5 * time.Second):
             return fmt.Errorf("timeout sending audio frame")
         }
@@ -449,38 +484,73 @@ func (b *Bot) playAudioStream(vc *discordgo.VoiceConnection, url string) error {
 
 // handleSkipCommand handles skip command
 func (b *Bot) handleSkipCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
+	b.musicMu.Lock()
 	session := b.getOrCreateMusicSession(m.GuildID)
+	empty := len(session.Queue.Tracks) == 0
+	if !empty {
+		session.Queue.Current++
+	}
+	b.musicMu.Unlock()
 
-	if len(session.Queue.Tracks) == 0 {
+	if empty {
 		s.ChannelMessageSend(m.ChannelID, "❌ Tidak ada lagu dalam queue!")
 		return
 	}
-
-	session.Queue.Current++
 	s.ChannelMessageSend(m.ChannelID, "⏭️ Melompati lagu saat ini...")
 }
 
 // handleStopCommand handles stop command
 func (b *Bot) handleStopCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
-	session := b.getOrCreateMusicSession(m.GuildID)
+	b.stopMusic(m.GuildID)
+	s.ChannelMessageSend(m.ChannelID, "⏹️ Musik dihentikan dan queue dibersihkan.")
+}
+
+// stopMusic stops playback for a guild, clears its queue and leaves voice
+func (b *Bot) stopMusic(guildID string) {
+	b.musicMu.Lock()
+	session := b.getOrCreateMusicSession(guildID)
 
 	session.Queue.IsPlaying = false
 	session.Queue.Tracks = []MusicTrack{}
 	session.Queue.Current = 0
 
-	if session.VoiceConn != nil {
-		session.VoiceConn.Disconnect()
-		session.VoiceConn = nil
+	if session.Stop != nil {
+		close(session.Stop)
+		session.Stop = nil
 	}
 
-	s.ChannelMessageSend(m.ChannelID, "⏹️ Musik dihentikan dan queue dibersihkan.")
+	voiceConn := session.VoiceConn
+	session.VoiceConn = nil
+	b.musicMu.Unlock()
+
+	if voiceConn != nil {
+		voiceConn.Disconnect()
+	}
+}
+
+// stopAllMusic stops music playback in every guild
+func (b *Bot) stopAllMusic() {
+	b.musicMu.Lock()
+	var guildIDs []string
+	for guildID := range b.musicSessions {
+		guildIDs = append(guildIDs, guildID)
+	}
+	b.musicMu.Unlock()
+
+	for _, guildID := range guildIDs {
+		b.stopMusic(guildID)
+	}
 }
 
 // handleQueueCommand handles queue command
 func (b *Bot) handleQueueCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
+	b.musicMu.Lock()
 	session := b.getOrCreateMusicSession(m.GuildID)
+	tracks := append([]MusicTrack(nil), session.Queue.Tracks...)
+	current := session.Queue.Current
+	b.musicMu.Unlock()
 
-	if len(session.Queue.Tracks) == 0 {
+	if len(tracks) == 0 {
 		s.ChannelMessageSend(m.ChannelID, "📋 Queue kosong!")
 		return
 	}
@@ -488,11 +558,11 @@ func (b *Bot) handleQueueCommand(s *discordgo.Session, m *discordgo.MessageCreat
 	var queueText strings.Builder
 	queueText.WriteString("📋 **Music Queue**\n\n")
 
-	for i, track := range session.Queue.Tracks {
+	for i, track := range tracks {
 		status := ""
-		if i == session.Queue.Current {
+		if i == current {
 			status = "🎵 **Now Playing**"
-		} else if i < session.Queue.Current {
+		} else if i < current {
 			status = "✅"
 		} else {
 			status = fmt.Sprintf("%d.", i+1)
@@ -505,9 +575,11 @@ func (b *Bot) handleQueueCommand(s *discordgo.Session, m *discordgo.MessageCreat
 
 // handlePauseCommand handles pause command
 func (b *Bot) handlePauseCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
-	session := b.getOrCreateMusicSession(m.GuildID)
+	b.musicMu.Lock()
+	playing := b.getOrCreateMusicSession(m.GuildID).Queue.IsPlaying
+	b.musicMu.Unlock()
 
-	if !session.Queue.IsPlaying {
+	if !playing {
 		s.ChannelMessageSend(m.ChannelID, "❌ Tidak ada musik yang sedang diputar!")
 		return
 	}
@@ -517,9 +589,11 @@ func (b *Bot) handlePauseCommand(s *discordgo.Session, m *discordgo.MessageCreat
 
 // handleResumeCommand handles resume command
 func (b *Bot) handleResumeCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
-	session := b.getOrCreateMusicSession(m.GuildID)
+	b.musicMu.Lock()
+	playing := b.getOrCreateMusicSession(m.GuildID).Queue.IsPlaying
+	b.musicMu.Unlock()
 
-	if session.Queue.IsPlaying {
+	if playing {
 		s.ChannelMessageSend(m.ChannelID, "❌ Musik sudah diputar!")
 		return
 	}
@@ -529,12 +603,14 @@ func (b *Bot) handleResumeCommand(s *discordgo.Session, m *discordgo.MessageCrea
 
 // handleLoopCommand handles loop command
 func (b *Bot) handleLoopCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
+	b.musicMu.Lock()
 	session := b.getOrCreateMusicSession(m.GuildID)
-
 	session.Queue.Loop = !session.Queue.Loop
+	loop := session.Queue.Loop
+	b.musicMu.Unlock()
 
 	status := "❌ OFF"
-	if session.Queue.Loop {
+	if loop {
 		status = "✅ ON"
 	}
 
@@ -548,6 +624,8 @@ func (b *Bot) handleVolumeCommand(s *discordgo.Session, m *discordgo.MessageCrea
 		return
 	}
 
+	b.musicMu.Lock()
 	b.getOrCreateMusicSession(m.GuildID)
+	b.musicMu.Unlock()
 	s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("🔊 Volume diatur ke: %s", parts[1]))
 }
\ No newline at end of file
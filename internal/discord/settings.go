@@ -0,0 +1,551 @@
+package discord
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+
+	"playstats/internal/database"
+	"playstats/pkg/utils"
+)
+
+// guildSettings gets a guild's settings, loading them on first use
+func (b *Bot) guildSettings(ctx context.Context, guildID string) database.GuildSettings {
+	b.settingsMu.RLock()
+	settings, cached := b.guildSettingsCache[guildID]
+	b.settingsMu.RUnlock()
+	if cached {
+		return settings
+	}
+
+	settings, err := b.repository.GetGuildSettingsContext(ctx, guildID)
+	if err != nil {
+		log.Printf("Error getting guild settings: %v", err)
+		return settings
+	}
+
+	b.settingsMu.Lock()
+	b.guildSettingsCache[guildID] = settings
+	b.settingsMu.Unlock()
+	return settings
+}
+
+// cachedGuildSettings gets a guild's settings from the cache without
+// loading them, for use while holding trackingMu. Callers load them with
+// guildSettings before taking the lock; until then the defaults apply.
+func (b *Bot) cachedGuildSettings(guildID string) database.GuildSettings {
+	b.settingsMu.RLock()
+	defer b.settingsMu.RUnlock()
+	if settings, cached := b.guildSettingsCache[guildID]; cached {
+		return settings
+	}
+	return database.GuildSettings{GuildID: guildID, MinHumans: 1}
+}
+
+// userSettings gets a user's settings, loading them on first use
+func (b *Bot) userSettings(ctx context.Context, userID string) database.UserSettings {
+	b.settingsMu.RLock()
+	settings, cached := b.userSettingsCache[userID]
+	b.settingsMu.RUnlock()
+	if cached {
+		return settings
+	}
+
+	settings, err := b.repository.GetUserSettingsContext(ctx, userID)
+	if err != nil {
+		log.Printf("Error getting user settings: %v", err)
+		return settings
+	}
+
+	b.settingsMu.Lock()
+	b.userSettingsCache[userID] = settings
+	b.settingsMu.Unlock()
+	return settings
+}
+
+// saveGuildSettings stores a guild's settings and refreshes the cache
+func (b *Bot) saveGuildSettings(ctx context.Context, settings database.GuildSettings) error {
+	if err := b.repository.SaveGuildSettingsContext(ctx, settings); err != nil {
+		return err
+	}
+
+	b.settingsMu.Lock()
+	b.guildSettingsCache[settings.GuildID] = settings
+	b.settingsMu.Unlock()
+	return nil
+}
+
+// saveUserSettings stores a user's settings and refreshes the cache
+func (b *Bot) saveUserSettings(ctx context.Context, settings database.UserSettings) error {
+	if err := b.repository.SaveUserSettingsContext(ctx, settings); err != nil {
+		return err
+	}
+
+	b.settingsMu.Lock()
+	b.userSettingsCache[settings.UserID] = settings
+	b.settingsMu.Unlock()
+	return nil
+}
+
+// ignoredChannels gets a guild's ignored voice channels, loading them on first use
+func (b *Bot) ignoredChannels(ctx context.Context, guildID string) map[string]bool {
+	b.settingsMu.RLock()
+	channels, cached := b.ignoredChannelsCache[guildID]
+	b.settingsMu.RUnlock()
+	if cached {
+		return channels
+	}
+
+	channelIDs, err := b.repository.GetIgnoredChannelsContext(ctx, guildID)
+	if err != nil {
+		log.Printf("Error getting ignored channels: %v", err)
+		return nil
+	}
+
+	channels = make(map[string]bool)
+	for _, channelID := range channelIDs {
+		channels[channelID] = true
+	}
+
+	b.settingsMu.Lock()
+	b.ignoredChannelsCache[guildID] = channels
+	b.settingsMu.Unlock()
+	return channels
+}
+
+// activityAliases gets a guild's activity aliases, loading them on first use
+func (b *Bot) activityAliases(ctx context.Context, guildID string) map[string]string {
+	b.settingsMu.RLock()
+	aliases, cached := b.activityAliasesCache[guildID]
+	b.settingsMu.RUnlock()
+	if cached {
+		return aliases
+	}
+
+	rows, err := b.repository.GetActivityAliasesContext(ctx, guildID)
+	if err != nil {
+		log.Printf("Error getting activity aliases: %v", err)
+		return nil
+	}
+
+	aliases = make(map[string]string)
+	for _, alias := range rows {
+		aliases[alias.Alias] = alias.ActivityName
+	}
+
+	b.settingsMu.Lock()
+	b.activityAliasesCache[guildID] = aliases
+	b.settingsMu.Unlock()
+	return aliases
+}
+
+// detailActivities gets the activities whose rich presence details a guild
+// tracks, keyed by utils.ActivityKey, loading them on first use
+func (b *Bot) detailActivities(ctx context.Context, guildID string) map[string]bool {
+	b.settingsMu.RLock()
+	activities, cached := b.detailActivitiesCache[guildID]
+	b.settingsMu.RUnlock()
+	if cached {
+		return activities
+	}
+
+	keys, err := b.repository.GetDetailActivitiesContext(ctx, guildID)
+	if err != nil {
+		log.Printf("Error getting detail activities: %v", err)
+		return nil
+	}
+
+	activities = make(map[string]bool)
+	for _, key := range keys {
+		activities[key] = true
+	}
+
+	b.settingsMu.Lock()
+	b.detailActivitiesCache[guildID] = activities
+	b.settingsMu.Unlock()
+	return activities
+}
+
+// resolveActivityName normalizes an activity name and applies the guild's
+// aliases, for the guild's activity totals, leaderboards and stats. Global
+// totals use the normalized name only.
+func (b *Bot) resolveActivityName(ctx context.Context, guildID, name string) string {
+	name = utils.NormalizeActivityName(name)
+	if activityName, exists := b.activityAliases(ctx, guildID)[strings.ToLower(name)]; exists {
+		return activityName
+	}
+	return name
+}
+
+// isIdleChannel checks if time in a voice channel should be kept out of the
+// voice totals: the guild's AFK channel or one of its ignored channels
+func (b *Bot) isIdleChannel(ctx context.Context, guildID, channelID string) bool {
+	if guild, err := b.session.State.Guild(guildID); err == nil && guild.AfkChannelID == channelID {
+		return true
+	}
+	return b.ignoredChannels(ctx, guildID)[channelID]
+}
+
+// guildLocation gets the timezone configured for a guild
+func (b *Bot) guildLocation(ctx context.Context, guildID string) *time.Location {
+	if loc := b.loadLocation(b.guildSettings(ctx, guildID).Timezone); loc != nil {
+		return loc
+	}
+	return b.defaultTZ
+}
+
+// location gets the timezone used for a user's stats in a guild: the
+// user's own timezone if set, otherwise the guild's
+func (b *Bot) location(ctx context.Context, guildID, userID string) *time.Location {
+	if loc := b.loadLocation(b.userSettings(ctx, userID).Timezone); loc != nil {
+		return loc
+	}
+	return b.guildLocation(ctx, guildID)
+}
+
+// loadLocation loads an IANA timezone, returning nil if it is empty or
+// unknown. Loaded timezones are cached so tzdata is only read once per name.
+func (b *Bot) loadLocation(name string) *time.Location {
+	if name == "" {
+		return nil
+	}
+
+	b.settingsMu.RLock()
+	loc, cached := b.locationsCache[name]
+	b.settingsMu.RUnlock()
+	if cached {
+		return loc
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		log.Printf("Error loading timezone %q: %v", name, err)
+		loc = nil
+	}
+
+	b.settingsMu.Lock()
+	b.locationsCache[name] = loc
+	b.settingsMu.Unlock()
+	return loc
+}
+
+// isGuildAdmin checks if the message author can manage the guild
+func (b *Bot) isGuildAdmin(s *discordgo.Session, m *discordgo.MessageCreate) bool {
+	perms, err := s.UserChannelPermissions(m.Author.ID, m.ChannelID)
+	if err != nil {
+		log.Printf("Error getting permissions: %v", err)
+		return false
+	}
+	return perms&discordgo.PermissionManageGuild != 0
+}
+
+// handleTimezoneCommand handles the !timezone command
+func (b *Bot) handleTimezoneCommand(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) {
+	parts := strings.Fields(strings.TrimSpace(m.Content))
+	usage := "Format: !timezone | !timezone <zona IANA|reset> | !timezone me <zona IANA|reset>"
+
+	switch {
+	case len(parts) == 1:
+		guildTZ := b.guildLocation(ctx, m.GuildID).String()
+		userTZ := b.userSettings(ctx, m.Author.ID).Timezone
+		if userTZ == "" {
+			userTZ = "(mengikuti server)"
+		}
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("🕒 Zona waktu server: %s\n🕒 Zona waktu %s: %s",
+			guildTZ, m.Author.Username, userTZ))
+
+	case len(parts) == 3 && parts[1] == "me":
+		timezone, ok := b.parseTimezoneArg(s, m, parts[2])
+		if !ok {
+			return
+		}
+		if err := b.saveUserSettings(ctx, database.UserSettings{UserID: m.Author.ID, Timezone: timezone}); err != nil {
+			log.Printf("Error saving user settings: %v", err)
+			s.ChannelMessageSend(m.ChannelID, "Terjadi kesalahan menyimpan zona waktu.")
+			return
+		}
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("✅ Zona waktu %s: %s",
+			m.Author.Username, b.location(ctx, m.GuildID, m.Author.ID)))
+
+	case len(parts) == 2:
+		if !b.isGuildAdmin(s, m) {
+			s.ChannelMessageSend(m.ChannelID, "❌ Hanya admin server (Manage Server) yang bisa mengubah zona waktu server.")
+			return
+		}
+		timezone, ok := b.parseTimezoneArg(s, m, parts[1])
+		if !ok {
+			return
+		}
+		settings := b.guildSettings(ctx, m.GuildID)
+		settings.Timezone = timezone
+		if err := b.saveGuildSettings(ctx, settings); err != nil {
+			log.Printf("Error saving guild settings: %v", err)
+			s.ChannelMessageSend(m.ChannelID, "Terjadi kesalahan menyimpan zona waktu.")
+			return
+		}
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("✅ Zona waktu server: %s", b.guildLocation(ctx, m.GuildID)))
+
+	default:
+		s.ChannelMessageSend(m.ChannelID, usage)
+	}
+}
+
+// parseTimezoneArg validates a timezone argument; "reset" clears the setting
+func (b *Bot) parseTimezoneArg(s *discordgo.Session, m *discordgo.MessageCreate, arg string) (string, bool) {
+	if strings.EqualFold(arg, "reset") {
+		return "", true
+	}
+	if _, err := time.LoadLocation(arg); err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("❌ Zona waktu tidak dikenal: %s (contoh: Asia/Jakarta)", arg))
+		return "", false
+	}
+	return arg, true
+}
+
+// handleIgnoreCommand handles the !ignore and !unignore commands
+func (b *Bot) handleIgnoreCommand(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) {
+	parts := strings.Fields(strings.TrimSpace(m.Content))
+	ignore := parts[0] == "!ignore"
+
+	if len(parts) == 1 && ignore {
+		var lines []string
+		if guild, err := s.State.Guild(m.GuildID); err == nil && guild.AfkChannelID != "" {
+			lines = append(lines, fmt.Sprintf("%s (AFK)", utils.FormatChannelMention(guild.AfkChannelID)))
+		}
+		for channelID := range b.ignoredChannels(ctx, m.GuildID) {
+			lines = append(lines, utils.FormatChannelMention(channelID))
+		}
+		if len(lines) == 0 {
+			lines = append(lines, "(tidak ada)")
+		}
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("🔇 Channel voice yang tidak dihitung:\n%s", strings.Join(lines, "\n")))
+		return
+	}
+
+	if len(parts) != 2 || !utils.IsChannelMention(parts[1]) {
+		s.ChannelMessageSend(m.ChannelID, "Format: !ignore | !ignore #channel | !unignore #channel")
+		return
+	}
+	if !b.isGuildAdmin(s, m) {
+		s.ChannelMessageSend(m.ChannelID, "❌ Hanya admin server (Manage Server) yang bisa mengubah channel yang diabaikan.")
+		return
+	}
+
+	channelID := utils.ExtractChannelIDFromMention(parts[1])
+
+	// Time already spent in the channel is credited as it was counted
+	// before the change
+	b.settleChannelSessions(ctx, m.GuildID, channelID, time.Now().UTC())
+
+	var err error
+	if ignore {
+		err = b.repository.AddIgnoredChannelContext(ctx, m.GuildID, channelID)
+	} else {
+		err = b.repository.RemoveIgnoredChannelContext(ctx, m.GuildID, channelID)
+	}
+	if err != nil {
+		log.Printf("Error updating ignored channels: %v", err)
+		s.ChannelMessageSend(m.ChannelID, "Terjadi kesalahan menyimpan channel yang diabaikan.")
+		return
+	}
+
+	// Reload on next use
+	b.settingsMu.Lock()
+	delete(b.ignoredChannelsCache, m.GuildID)
+	b.settingsMu.Unlock()
+
+	if ignore {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("🔇 %s tidak lagi dihitung di statistik voice.", parts[1]))
+	} else {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("🔊 %s kembali dihitung di statistik voice.", parts[1]))
+	}
+}
+
+// handleExcludeDeafCommand handles the !excludedeaf command
+func (b *Bot) handleExcludeDeafCommand(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) {
+	parts := strings.Fields(strings.TrimSpace(m.Content))
+	settings := b.guildSettings(ctx, m.GuildID)
+
+	if len(parts) == 1 {
+		status := "❌ OFF"
+		if settings.ExcludeDeafened {
+			status = "✅ ON"
+		}
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("🙉 Waktu deafen tidak dihitung di leaderboard: %s", status))
+		return
+	}
+
+	if len(parts) != 2 || (parts[1] != "on" && parts[1] != "off") {
+		s.ChannelMessageSend(m.ChannelID, "Format: !excludedeaf | !excludedeaf on|off")
+		return
+	}
+	if !b.isGuildAdmin(s, m) {
+		s.ChannelMessageSend(m.ChannelID, "❌ Hanya admin server (Manage Server) yang bisa mengubah pengaturan ini.")
+		return
+	}
+
+	settings.ExcludeDeafened = parts[1] == "on"
+	if err := b.saveGuildSettings(ctx, settings); err != nil {
+		log.Printf("Error saving guild settings: %v", err)
+		s.ChannelMessageSend(m.ChannelID, "Terjadi kesalahan menyimpan pengaturan.")
+		return
+	}
+	s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("✅ Waktu deafen tidak dihitung di leaderboard: %s", parts[1]))
+}
+
+// handleMinHumansCommand handles the !minhumans command
+func (b *Bot) handleMinHumansCommand(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) {
+	parts := strings.Fields(strings.TrimSpace(m.Content))
+	settings := b.guildSettings(ctx, m.GuildID)
+
+	if len(parts) == 1 {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("👥 Voice dihitung jika ada minimal %d orang (bukan bot) di channel", settings.MinHumans))
+		return
+	}
+
+	minHumans, err := strconv.Atoi(parts[1])
+	if len(parts) != 2 || err != nil || minHumans < 1 {
+		s.ChannelMessageSend(m.ChannelID, "Format: !minhumans | !minhumans <angka minimal 1>")
+		return
+	}
+	if !b.isGuildAdmin(s, m) {
+		s.ChannelMessageSend(m.ChannelID, "❌ Hanya admin server (Manage Server) yang bisa mengubah pengaturan ini.")
+		return
+	}
+
+	settings.MinHumans = minHumans
+	if err := b.saveGuildSettings(ctx, settings); err != nil {
+		log.Printf("Error saving guild settings: %v", err)
+		s.ChannelMessageSend(m.ChannelID, "Terjadi kesalahan menyimpan pengaturan.")
+		return
+	}
+	b.updateGuildOccupancy(ctx, m.GuildID, time.Now().UTC())
+	s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("✅ Voice sekarang dihitung jika ada minimal %d orang di channel", minHumans))
+}
+
+// handleAliasCommand handles the !alias and !unalias commands
+func (b *Bot) handleAliasCommand(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) {
+	content := strings.TrimSpace(m.Content)
+	command := strings.Fields(content)[0]
+	args := strings.TrimSpace(strings.TrimPrefix(content, command))
+
+	if command == "!alias" && args == "" {
+		var lines []string
+		for alias, activityName := range b.activityAliases(ctx, m.GuildID) {
+			lines = append(lines, fmt.Sprintf("%s → %s", alias, activityName))
+		}
+		sort.Strings(lines)
+		if len(lines) == 0 {
+			lines = append(lines, "(tidak ada)")
+		}
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("🏷️ Alias aktivitas:\n%s", strings.Join(lines, "\n")))
+		return
+	}
+
+	alias, activityName, hasTarget := strings.Cut(args, "=")
+	alias = utils.ActivityKey(alias)
+	activityName = utils.NormalizeActivityName(activityName)
+	var valid bool
+	switch command {
+	case "!alias":
+		valid = alias != "" && activityName != ""
+	case "!unalias":
+		valid = alias != "" && !hasTarget
+	}
+	if !valid {
+		s.ChannelMessageSend(m.ChannelID, "Format: !alias | !alias <nama lain> = <nama game> | !unalias <nama lain>")
+		return
+	}
+	if !b.isGuildAdmin(s, m) {
+		s.ChannelMessageSend(m.ChannelID, "❌ Hanya admin server (Manage Server) yang bisa mengubah alias aktivitas.")
+		return
+	}
+
+	var err error
+	if command == "!alias" {
+		err = b.repository.SaveActivityAliasContext(ctx, database.ActivityAlias{
+			GuildID:      m.GuildID,
+			Alias:        alias,
+			ActivityName: activityName,
+		})
+	} else {
+		err = b.repository.DeleteActivityAliasContext(ctx, m.GuildID, alias)
+	}
+	if err != nil {
+		log.Printf("Error updating activity aliases: %v", err)
+		s.ChannelMessageSend(m.ChannelID, "Terjadi kesalahan menyimpan alias aktivitas.")
+		return
+	}
+
+	// Reload on next use
+	b.settingsMu.Lock()
+	delete(b.activityAliasesCache, m.GuildID)
+	b.settingsMu.Unlock()
+
+	if command == "!alias" {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("🏷️ \"%s\" sekarang dicatat sebagai %s.", alias, activityName))
+	} else {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("🏷️ Alias \"%s\" dihapus.", alias))
+	}
+}
+
+// handleDetailsCommand handles the !details command, which turns rich
+// presence detail tracking of a game on or off
+func (b *Bot) handleDetailsCommand(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) {
+	parts := strings.Fields(m.Content)
+
+	if len(parts) == 1 {
+		var games []string
+		for key := range b.detailActivities(ctx, m.GuildID) {
+			games = append(games, key)
+		}
+		sort.Strings(games)
+		if len(games) == 0 {
+			games = append(games, "(tidak ada)")
+		}
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("🗺️ Detail mode/map dicatat untuk:\n%s", strings.Join(games, "\n")))
+		return
+	}
+
+	var name string
+	if len(parts) > 2 {
+		name = b.resolveActivityName(ctx, m.GuildID, strings.Join(parts[2:], " "))
+	}
+	if name == "" || (parts[1] != "on" && parts[1] != "off") {
+		s.ChannelMessageSend(m.ChannelID, "Format: !details | !details on <nama game> | !details off <nama game>")
+		return
+	}
+	if !b.isGuildAdmin(s, m) {
+		s.ChannelMessageSend(m.ChannelID, "❌ Hanya admin server (Manage Server) yang bisa mengubah pencatatan detail.")
+		return
+	}
+
+	var err error
+	if parts[1] == "on" {
+		err = b.repository.AddDetailActivityContext(ctx, m.GuildID, utils.ActivityKey(name))
+	} else {
+		err = b.repository.RemoveDetailActivityContext(ctx, m.GuildID, utils.ActivityKey(name))
+	}
+	if err != nil {
+		log.Printf("Error updating detail activities: %v", err)
+		s.ChannelMessageSend(m.ChannelID, "Terjadi kesalahan menyimpan pengaturan detail.")
+		return
+	}
+
+	// Reload on next use
+	b.settingsMu.Lock()
+	delete(b.detailActivitiesCache, m.GuildID)
+	b.settingsMu.Unlock()
+
+	if parts[1] == "on" {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("🗺️ Detail mode/map %s sekarang dicatat.", name))
+	} else {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("🗺️ Detail mode/map %s tidak lagi dicatat.", name))
+	}
+}
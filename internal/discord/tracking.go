@@ -0,0 +1,1204 @@
+package discord
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+
+	"playstats/internal/database"
+	"playstats/internal/models"
+	"playstats/pkg/utils"
+)
+
+const (
+	// heartbeatInterval controls how often open sessions are marked as still alive
+	heartbeatInterval = time.Minute
+
+	// resumeWindow is how recent a recovered session's heartbeat must be for
+	// it to be resumed instead of closed
+	resumeWindow = 10 * time.Minute
+
+	// recoveryGrace is how long after Ready recovered sessions may wait for
+	// a matching voice state or presence before they are closed
+	recoveryGrace = 2 * time.Minute
+)
+
+// heartbeat periodically marks open sessions as alive so a crash only
+// loses the time since the last beat
+func (b *Bot) heartbeat() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-ticker.C:
+			now := time.Now().UTC()
+			b.trackingMu.Lock()
+			b.closeEndedActivitySessions(b.ctx, "", now)
+			b.trackingMu.Unlock()
+			b.runStoreQueue()
+			if err := b.repository.TouchOpenSessionsContext(b.ctx, b.runID, now); err != nil {
+				log.Printf("Error touching open sessions: %v", err)
+			}
+		}
+	}
+}
+
+// checkpoint periodically flushes the elapsed time of every open session
+// to the totals while keeping the sessions open
+func (b *Bot) checkpoint() {
+	if b.checkpointInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(b.checkpointInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-ticker.C:
+			b.checkpointSessions(b.ctx, time.Now().UTC())
+		}
+	}
+}
+
+// checkpointSessions credits every open session up to now
+func (b *Bot) checkpointSessions(ctx context.Context, now time.Time) {
+	b.trackingMu.Lock()
+	for key := range b.sessions {
+		guildID, userID, _ := strings.Cut(key, ":")
+		b.settleVoiceSession(ctx, key, userID, guildID, now)
+	}
+
+	for key, session := range b.activitySessions {
+		userID, activityName, _ := strings.Cut(key, ":")
+		// Ended sessions still within the grace period are only credited up
+		// to when the activity disappeared
+		end := now
+		if !session.Ended.IsZero() {
+			end = session.Ended
+		}
+		b.creditActivity(ctx, userID, activityName, &session, end)
+		b.activitySessions[key] = session
+		b.saveOpenActivitySession(ctx, userID, activityName, session, now)
+	}
+	voice, activities := len(b.sessions), len(b.activitySessions)
+	b.trackingMu.Unlock()
+	b.runStoreQueue()
+
+	if voice+activities > 0 {
+		log.Printf("checkpoint: %d voice, %d activity sessions", voice, activities)
+	}
+}
+
+// closeAllSessions closes every open voice and activity session at now
+func (b *Bot) closeAllSessions(ctx context.Context, now time.Time) {
+	b.trackingMu.Lock()
+	for _, key := range sessionKeys(b.sessions, "") {
+		guildID, userID, _ := strings.Cut(key, ":")
+		b.closeVoiceSession(ctx, key, userID, guildID, now)
+	}
+	for _, key := range sessionKeys(b.activitySessions, "") {
+		userID, activityName, _ := strings.Cut(key, ":")
+		b.closeActivitySession(ctx, userID, activityName, now)
+	}
+	b.trackingMu.Unlock()
+	b.runStoreQueue()
+}
+
+// queueStore queues store or settings I/O made while tracking sessions, to
+// run once trackingMu is released so handlers don't hold it while waiting
+// on the database. Queued work runs in the order it was queued.
+func (b *Bot) queueStore(work func()) {
+	b.storeMu.Lock()
+	b.storeQueue = append(b.storeQueue, work)
+	b.storeMu.Unlock()
+}
+
+// runStoreQueue runs queued store work, including work queued meanwhile by
+// other handlers, until the queue is empty. It must not be called while
+// holding trackingMu.
+func (b *Bot) runStoreQueue() {
+	b.storeRunMu.Lock()
+	defer b.storeRunMu.Unlock()
+
+	for {
+		b.storeMu.Lock()
+		queue := b.storeQueue
+		b.storeQueue = nil
+		b.storeMu.Unlock()
+		if len(queue) == 0 {
+			return
+		}
+		for _, work := range queue {
+			work()
+		}
+	}
+}
+
+// sessionKeys returns the keys of a session map starting with prefix, so
+// the sessions can be closed while walking them. The caller must hold
+// trackingMu.
+func sessionKeys[T any](sessions map[string]T, prefix string) []string {
+	var keys []string
+	for key := range sessions {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// recoverOpenSessions loads sessions left open by a previous run. They are
+// resumed when the gateway reports the same state on startup, and closed at
+// their last heartbeat otherwise.
+func (b *Bot) recoverOpenSessions(ctx context.Context) {
+	sessions, err := b.repository.GetOpenSessionsContext(ctx)
+	if err != nil {
+		log.Printf("Error getting open sessions: %v", err)
+		return
+	}
+
+	b.recoveredMu.Lock()
+	defer b.recoveredMu.Unlock()
+	for _, session := range sessions {
+		guildID := session.GuildID
+		if session.Kind == database.SessionKindActivity {
+			// Activity sessions are global per user; the guild only
+			// tells us where to report the time
+			guildID = ""
+		}
+		b.recovered[recoveredKey(session.Kind, guildID, session.UserID, session.Subject)] = session
+	}
+	if len(sessions) > 0 {
+		fmt.Printf("♻️ Loaded %d open sessions from previous run\n", len(sessions))
+	}
+}
+
+// recoveredKey builds the lookup key for a recovered session
+func recoveredKey(kind, guildID, userID, subject string) string {
+	return kind + ":" + guildID + ":" + userID + ":" + subject
+}
+
+// resume returns the start and credited times of a matching recovered
+// session if it can be resumed, or now for both otherwise. Activity
+// sessions are matched with an empty guildID.
+func (b *Bot) resume(ctx context.Context, kind, guildID, userID, subject string, now time.Time) (start, credited time.Time) {
+	b.recoveredMu.Lock()
+	defer b.recoveredMu.Unlock()
+
+	key := recoveredKey(kind, guildID, userID, subject)
+	session, exists := b.recovered[key]
+	if !exists {
+		return now, now
+	}
+	delete(b.recovered, key)
+
+	if now.Sub(session.LastSeen) > resumeWindow {
+		b.closeRecoveredSession(ctx, session)
+		return now, now
+	}
+	b.queueStore(func() {
+		if session.GuildID != guildID {
+			// Activity sessions are saved again under whichever guild
+			// reports them first, so the recovered row would otherwise be
+			// kept alive by heartbeats and credited again after the next
+			// restart
+			if err := b.repository.DeleteOpenSessionContext(ctx, session.Kind, session.UserID, session.GuildID, session.Subject); err != nil {
+				log.Printf("Error deleting resumed open session: %v", err)
+			}
+		}
+		fmt.Printf("♻️ Resumed %s session: user=%s guild=%s %s since %s\n",
+			session.Kind, session.UserID, session.GuildID, session.Subject, session.StartedAt.In(b.location(ctx, session.GuildID, session.UserID)))
+	})
+	return session.StartedAt, session.CreditedUntil
+}
+
+// closeRecoveredSessions closes recovered sessions matching the filter at
+// their last heartbeat
+func (b *Bot) closeRecoveredSessions(ctx context.Context, match func(database.OpenSession) bool) {
+	b.recoveredMu.Lock()
+	for key, session := range b.recovered {
+		if !match(session) {
+			continue
+		}
+		delete(b.recovered, key)
+		b.closeRecoveredSession(ctx, session)
+	}
+	b.recoveredMu.Unlock()
+	b.runStoreQueue()
+}
+
+// closeRecoveredSession credits a recovered session up to its last
+// heartbeat, or an activity that had ended up to when it did. It runs from
+// the store queue, since naming the activity may load the guild's aliases.
+func (b *Bot) closeRecoveredSession(ctx context.Context, session database.OpenSession) {
+	b.queueStore(func() {
+		var seconds int64
+		switch session.Kind {
+		case database.SessionKindVoice:
+			voice := models.VoiceSession{Credited: session.CreditedUntil, ChannelID: session.Subject}
+			seconds = b.creditVoice(ctx, session.UserID, session.GuildID, &voice, session.LastSeen)
+		case database.SessionKindActivity:
+			activity := models.ActivitySession{
+				Start:    session.StartedAt,
+				Credited: session.CreditedUntil,
+				GuildID:  session.GuildID,
+				Guilds: map[string]models.ActivityGuild{
+					session.GuildID: {Name: b.resolveActivityName(ctx, session.GuildID, session.Subject)},
+				},
+			}
+			end := session.LastSeen
+			if !session.Ended.IsZero() && session.Ended.Before(end) {
+				end = session.Ended
+			}
+			seconds = b.creditActivity(ctx, session.UserID, session.Subject, &activity, end)
+		}
+
+		// Queued behind the credited time, so the row only goes once the
+		// time is written
+		b.queueStore(func() {
+			if err := b.repository.DeleteOpenSessionContext(ctx, session.Kind, session.UserID, session.GuildID, session.Subject); err != nil {
+				log.Printf("Error deleting open session: %v", err)
+			}
+			fmt.Printf("♻️ Closed %s session from previous run: user=%s guild=%s %s, +%d seconds\n",
+				session.Kind, session.UserID, session.GuildID, session.Subject, seconds)
+		})
+	})
+}
+
+// ready closes recovered sessions that were not matched by the gateway
+// state once the guilds have had time to arrive
+func (b *Bot) ready(s *discordgo.Session, r *discordgo.Ready) {
+	log.Printf("ready: %d guilds", len(r.Guilds))
+	time.AfterFunc(recoveryGrace, func() {
+		b.closeRecoveredSessions(b.ctx, func(database.OpenSession) bool { return true })
+	})
+}
+
+// guildCreate reconciles tracked sessions with the guild's current voice
+// states and presences, so members already in voice or playing are tracked
+// immediately after connecting
+func (b *Bot) guildCreate(s *discordgo.Session, g *discordgo.GuildCreate) {
+	ctx := b.ctx
+	guildID := g.ID
+	now := time.Now().UTC()
+
+	// Load the guild's settings now; they are only read from the cache
+	// while trackingMu is held
+	b.guildSettings(ctx, guildID)
+
+	b.trackingMu.Lock()
+
+	// Voice: open or move sessions for members currently in a channel
+	var seeded []*discordgo.VoiceState
+	inVoice := make(map[string]bool)
+	for _, vs := range g.VoiceStates {
+		if vs.ChannelID == "" {
+			continue
+		}
+		userID := vs.UserID
+		key := guildID + ":" + userID
+		inVoice[key] = true
+
+		flags := voiceFlags(vs)
+		current, tracked := b.sessions[key]
+		if tracked && current.ChannelID == vs.ChannelID {
+			if current.Flags != flags {
+				b.settleVoiceSession(ctx, key, userID, guildID, now)
+				b.setVoiceFlags(key, flags)
+			}
+			continue
+		}
+		if tracked {
+			b.closeVoiceSession(ctx, key, userID, guildID, now)
+		}
+		b.openVoiceSession(ctx, key, userID, guildID, vs.ChannelID, flags, !b.isBot(vs), now)
+		seeded = append(seeded, vs)
+	}
+
+	// Close sessions for members that left while we were disconnected
+	prefix := guildID + ":"
+	for _, key := range sessionKeys(b.sessions, prefix) {
+		if inVoice[key] {
+			continue
+		}
+		userID := strings.TrimPrefix(key, prefix)
+		seconds := b.closeVoiceSession(ctx, key, userID, guildID, now)
+		fmt.Printf("⬅️ Leave (reconcile): %s, +%d seconds\n", userID, seconds)
+	}
+
+	b.trackingMu.Unlock()
+	b.runStoreQueue()
+
+	for _, vs := range seeded {
+		fmt.Printf("🔎 Seed: %s (%s) channel=%s (%s)\n",
+			b.username(s, guildID, vs.UserID), vs.UserID, vs.ChannelID, b.channelName(s, vs.ChannelID))
+	}
+
+	// Recovered voice sessions for this guild that did not match are stale
+	b.closeRecoveredSessions(ctx, func(session database.OpenSession) bool {
+		return session.Kind == database.SessionKindVoice && session.GuildID == guildID
+	})
+
+	// Activities: treat each presence snapshot like a presence update
+	present := make(map[string]bool)
+	for _, p := range g.Presences {
+		if p.User == nil {
+			continue
+		}
+		present[p.User.ID] = true
+		b.trackPresence(ctx, s, guildID, p.User.ID, p.Activities)
+	}
+
+	// Offline members are left out of the snapshot, so their activities no
+	// longer count here. Large guilds only send some presences, so missing
+	// members there say nothing.
+	if !g.Large {
+		b.trackingMu.Lock()
+		b.removeGuildActivities(ctx, guildID, present, time.Now().UTC())
+		b.trackingMu.Unlock()
+		b.runStoreQueue()
+	}
+}
+
+// guildDelete closes voice sessions and stops counting activities in a
+// guild the bot was removed from. Outages are left to guildCreate to
+// reconcile once the guild is available again.
+func (b *Bot) guildDelete(s *discordgo.Session, g *discordgo.GuildDelete) {
+	if g.Unavailable {
+		return
+	}
+	ctx := b.ctx
+	guildID := g.ID
+	now := time.Now().UTC()
+
+	b.trackingMu.Lock()
+	prefix := guildID + ":"
+	for _, key := range sessionKeys(b.sessions, prefix) {
+		userID := strings.TrimPrefix(key, prefix)
+		seconds := b.closeVoiceSession(ctx, key, userID, guildID, now)
+		fmt.Printf("⬅️ Leave (guild removed): %s, +%d seconds\n", userID, seconds)
+	}
+	b.removeGuildActivities(ctx, guildID, nil, now)
+	b.trackingMu.Unlock()
+	b.runStoreQueue()
+
+	fmt.Printf("👋 Removed from guild %s\n", guildID)
+}
+
+// voiceStateUpdate handles voice state updates
+func (b *Bot) voiceStateUpdate(s *discordgo.Session, vs *discordgo.VoiceStateUpdate) {
+	ctx := b.ctx
+	userID := vs.UserID
+	guildID := vs.GuildID
+	key := guildID + ":" + userID
+	flags := voiceFlags(vs.VoiceState)
+
+	// Load the guild's settings now; they are only read from the cache
+	// while trackingMu is held
+	b.guildSettings(ctx, guildID)
+
+	b.trackingMu.Lock()
+	current, tracked := b.sessions[key]
+	if !tracked && vs.ChannelID == "" {
+		b.trackingMu.Unlock()
+		return
+	}
+
+	now := time.Now().UTC()
+	if tracked && current.ChannelID == vs.ChannelID {
+		// Mute, deafen, stream or camera change without changing channel
+		if current.Flags != flags {
+			b.settleVoiceSession(ctx, key, userID, guildID, now)
+			b.setVoiceFlags(key, flags)
+			log.Printf("voice state: user=%s guild=%s muted=%t deafened=%t streaming=%t video=%t",
+				userID, guildID, flags.Muted, flags.Deafened, flags.Streaming, flags.Video)
+		}
+		b.trackingMu.Unlock()
+		b.runStoreQueue()
+		return
+	}
+
+	var durationSeconds int64
+	if tracked {
+		durationSeconds = b.closeVoiceSession(ctx, key, userID, guildID, now)
+	}
+	if vs.ChannelID != "" {
+		b.openVoiceSession(ctx, key, userID, guildID, vs.ChannelID, flags, !b.isBot(vs.VoiceState), now)
+	}
+	b.trackingMu.Unlock()
+	b.runStoreQueue()
+
+	username := b.username(s, guildID, userID)
+	switch {
+	case !tracked:
+		// Join channel
+		fmt.Printf("➡️ Join: %s (%s) %s channel=%s (%s)\n",
+			username, userID, now.In(b.location(ctx, guildID, userID)), vs.ChannelID, b.channelName(s, vs.ChannelID))
+
+	case vs.ChannelID == "":
+		// Leave channel
+		fmt.Printf("⬅️ Leave: %s (%s), +%d seconds channel=%s (%s)\n",
+			username, userID, durationSeconds, current.ChannelID, b.channelName(s, current.ChannelID))
+
+	default:
+		// Move between channels: the old segment was closed and a new one opened
+		fmt.Printf("🔀 Move: %s (%s), +%d seconds channel=%s (%s) -> channel=%s (%s)\n",
+			username, userID, durationSeconds, current.ChannelID, b.channelName(s, current.ChannelID),
+			vs.ChannelID, b.channelName(s, vs.ChannelID))
+	}
+}
+
+// voiceFlags extracts the tracked flags from a voice state
+func voiceFlags(vs *discordgo.VoiceState) models.VoiceFlags {
+	deafened := vs.SelfDeaf || vs.Deaf
+	return models.VoiceFlags{
+		Muted:     (vs.SelfMute || vs.Mute) && !deafened,
+		Deafened:  deafened,
+		Streaming: vs.SelfStream,
+		Video:     vs.SelfVideo,
+	}
+}
+
+// isBot checks if a voice state belongs to a bot account
+func (b *Bot) isBot(vs *discordgo.VoiceState) bool {
+	if vs.Member != nil && vs.Member.User != nil {
+		return vs.Member.User.Bot
+	}
+	if member, err := b.session.State.Member(vs.GuildID, vs.UserID); err == nil && member.User != nil {
+		return member.User.Bot
+	}
+	return false
+}
+
+// openVoiceSession starts tracking a voice session in a channel and adds
+// human users to the channel's occupancy. The caller must hold trackingMu.
+func (b *Bot) openVoiceSession(ctx context.Context, key, userID, guildID, channelID string, flags models.VoiceFlags, human bool, now time.Time) {
+	channelKey := guildID + ":" + channelID
+	if human {
+		if b.occupancy[channelKey] == nil {
+			b.occupancy[channelKey] = make(map[string]bool)
+		}
+		b.occupancy[channelKey][userID] = true
+	}
+
+	start, credited := b.resume(ctx, database.SessionKindVoice, guildID, userID, channelID, now)
+	session := models.VoiceSession{
+		Start:     start,
+		Credited:  credited,
+		ChannelID: channelID,
+		Flags:     flags,
+		Solo:      b.isSolo(guildID, channelID),
+	}
+	b.sessions[key] = session
+	b.saveOpenVoiceSession(ctx, userID, guildID, session, now)
+	b.updateOccupancy(ctx, guildID, channelID, now)
+}
+
+// isSolo checks if a channel has fewer humans than the guild requires for
+// voice time to count. The caller must hold trackingMu.
+func (b *Bot) isSolo(guildID, channelID string) bool {
+	return len(b.occupancy[guildID+":"+channelID]) < b.cachedGuildSettings(guildID).MinHumans
+}
+
+// updateOccupancy settles the sessions in a channel whose solo state no
+// longer matches the channel's occupancy, so the time before the change is
+// credited under the old state. The caller must hold trackingMu.
+func (b *Bot) updateOccupancy(ctx context.Context, guildID, channelID string, now time.Time) {
+	solo := b.isSolo(guildID, channelID)
+	prefix := guildID + ":"
+	for key, session := range b.sessions {
+		if !strings.HasPrefix(key, prefix) || session.ChannelID != channelID || session.Solo == solo {
+			continue
+		}
+		userID := strings.TrimPrefix(key, prefix)
+		b.settleVoiceSession(ctx, key, userID, guildID, now)
+		session = b.sessions[key]
+		session.Solo = solo
+		b.sessions[key] = session
+		log.Printf("voice occupancy: user=%s guild=%s channel=%s solo=%t", userID, guildID, channelID, solo)
+	}
+}
+
+// updateGuildOccupancy re-evaluates the solo state of every voice session
+// in a guild, e.g. after its minimum humans setting changed
+func (b *Bot) updateGuildOccupancy(ctx context.Context, guildID string, now time.Time) {
+	b.guildSettings(ctx, guildID)
+
+	b.trackingMu.Lock()
+	channels := make(map[string]bool)
+	prefix := guildID + ":"
+	for key, session := range b.sessions {
+		if strings.HasPrefix(key, prefix) {
+			channels[session.ChannelID] = true
+		}
+	}
+	for channelID := range channels {
+		b.updateOccupancy(ctx, guildID, channelID, now)
+	}
+	b.trackingMu.Unlock()
+	b.runStoreQueue()
+}
+
+// settleChannelSessions credits the voice sessions in a channel up to now
+// under the current settings, e.g. before the channel is ignored or counted
+// again. The credits are written before it returns, so they see the
+// settings as they were.
+func (b *Bot) settleChannelSessions(ctx context.Context, guildID, channelID string, now time.Time) {
+	b.guildSettings(ctx, guildID)
+
+	b.trackingMu.Lock()
+	prefix := guildID + ":"
+	for _, key := range sessionKeys(b.sessions, prefix) {
+		if b.sessions[key].ChannelID == channelID {
+			b.settleVoiceSession(ctx, key, strings.TrimPrefix(key, prefix), guildID, now)
+		}
+	}
+	b.trackingMu.Unlock()
+	b.runStoreQueue()
+}
+
+// settleVoiceSession credits a voice session up to now while keeping it
+// open. The caller must hold trackingMu.
+func (b *Bot) settleVoiceSession(ctx context.Context, key, userID, guildID string, now time.Time) {
+	session := b.sessions[key]
+	b.creditVoice(ctx, userID, guildID, &session, now)
+	b.sessions[key] = session
+	b.saveOpenVoiceSession(ctx, userID, guildID, session, now)
+}
+
+// setVoiceFlags updates the flags of a settled voice session, starting a new
+// session log row. The caller must hold trackingMu.
+func (b *Bot) setVoiceFlags(key string, flags models.VoiceFlags) {
+	session := b.sessions[key]
+	session.Flags = flags
+	session.Log = nil
+	b.sessions[key] = session
+}
+
+// closeVoiceSession stops tracking a voice session, credits the time since
+// the last checkpoint, removes the user from the channel's occupancy and
+// returns the session's total duration. The caller must hold trackingMu.
+func (b *Bot) closeVoiceSession(ctx context.Context, key, userID, guildID string, now time.Time) int64 {
+	session := b.sessions[key]
+	delete(b.sessions, key)
+
+	b.creditVoice(ctx, userID, guildID, &session, now)
+
+	b.queueStore(func() {
+		if err := b.repository.DeleteOpenSessionContext(ctx, database.SessionKindVoice, userID, guildID, session.ChannelID); err != nil {
+			log.Printf("Error deleting open voice session: %v", err)
+		}
+	})
+
+	channelKey := guildID + ":" + session.ChannelID
+	delete(b.occupancy[channelKey], userID)
+	if len(b.occupancy[channelKey]) == 0 {
+		delete(b.occupancy, channelKey)
+	}
+	b.updateOccupancy(ctx, guildID, session.ChannelID, now)
+
+	return int64(now.Sub(session.Start).Seconds())
+}
+
+// saveOpenVoiceSession queues persisting an open voice session
+func (b *Bot) saveOpenVoiceSession(ctx context.Context, userID, guildID string, session models.VoiceSession, now time.Time) {
+	open := database.OpenSession{
+		Kind:          database.SessionKindVoice,
+		UserID:        userID,
+		GuildID:       guildID,
+		Subject:       session.ChannelID,
+		StartedAt:     session.Start,
+		CreditedUntil: session.Credited,
+		LastSeen:      now,
+		RunID:         b.runID,
+	}
+	b.queueStore(func() {
+		if err := b.repository.SaveOpenSessionContext(ctx, open); err != nil {
+			log.Printf("Error saving open voice session: %v", err)
+		}
+	})
+}
+
+// creditVoice adds a voice session's time since it was last credited up to
+// end to the session log and the user's guild, channel, state and period
+// totals, advances session.Credited and returns the credited seconds. Time
+// in AFK or ignored channels, or alone in a channel, goes to the idle totals
+// instead. The writes are queued with queueStore.
+func (b *Bot) creditVoice(ctx context.Context, userID, guildID string, session *models.VoiceSession, end time.Time) int64 {
+	start := session.Credited.Truncate(time.Second)
+	session.Credited = end
+	end = end.Truncate(time.Second)
+	seconds := int64(end.Sub(start) / time.Second)
+	if session.Log == nil {
+		session.Log = &models.SessionLogRow{}
+	}
+	credited := *session
+
+	b.queueStore(func() {
+		channelID, flags := credited.ChannelID, credited.Flags
+		idle := credited.Solo || b.isIdleChannel(ctx, guildID, channelID)
+		b.logVoice(ctx, userID, guildID, credited, idle, start, end)
+
+		if idle {
+			if err := b.repository.AddIdleSecondsContext(ctx, userID, guildID, seconds); err != nil {
+				log.Printf("Error adding idle seconds: %v", err)
+			}
+			return
+		}
+
+		if err := b.repository.AddVoiceSecondsContext(ctx, userID, guildID, seconds); err != nil {
+			log.Printf("Error adding voice seconds: %v", err)
+		}
+		if err := b.repository.AddChannelSecondsContext(ctx, userID, guildID, channelID, seconds); err != nil {
+			log.Printf("Error adding channel seconds: %v", err)
+		}
+		if flags != (models.VoiceFlags{}) {
+			var muted, deafened, streaming, video int64
+			if flags.Muted {
+				muted = seconds
+			}
+			if flags.Deafened {
+				deafened = seconds
+			}
+			if flags.Streaming {
+				streaming = seconds
+			}
+			if flags.Video {
+				video = seconds
+			}
+			if err := b.repository.AddVoiceStateSecondsContext(ctx, userID, guildID, muted, deafened, streaming, video); err != nil {
+				log.Printf("Error adding voice state seconds: %v", err)
+			}
+		}
+		b.creditPeriods(ctx, userID, guildID, "", start, end)
+	})
+	return seconds
+}
+
+// logVoice records a credited voice stretch in the session log, extending
+// the session's current row while its idle state is unchanged and starting
+// a new one in its place otherwise. It runs from the store queue.
+func (b *Bot) logVoice(ctx context.Context, userID, guildID string, session models.VoiceSession, idle bool, start, end time.Time) {
+	row := session.Log
+	if row.ID != 0 && row.Idle == idle {
+		if err := b.repository.ExtendSessionLogContext(ctx, row.ID, end); err != nil {
+			log.Printf("Error extending voice session log: %v", err)
+		}
+		return
+	}
+	if !end.After(start) {
+		return
+	}
+
+	id, err := b.repository.AddSessionLogContext(ctx, database.SessionLog{
+		Kind:      database.SessionKindVoice,
+		UserID:    userID,
+		GuildID:   guildID,
+		Subject:   session.ChannelID,
+		StartedAt: start,
+		EndedAt:   end,
+		Idle:      idle,
+		Muted:     session.Flags.Muted,
+		Deafened:  session.Flags.Deafened,
+		Streaming: session.Flags.Streaming,
+		Video:     session.Flags.Video,
+	})
+	if err != nil {
+		log.Printf("Error adding voice session log: %v", err)
+		return
+	}
+	row.ID, row.Idle = id, idle
+}
+
+// creditPeriods adds time between start and end to the daily and weekly
+// stats, splitting it at day and week boundaries. An empty activityName
+// records voice time. It runs from the store queue.
+func (b *Bot) creditPeriods(ctx context.Context, userID, guildID, activityName string, start, end time.Time) {
+	loc := b.location(ctx, guildID, userID)
+
+	weekly := make(map[string]int64)
+	for _, span := range utils.SplitByDay(start, end, loc) {
+		seconds := span.Seconds()
+		if seconds <= 0 {
+			continue
+		}
+
+		voiceSeconds, activitySeconds := seconds, int64(0)
+		if activityName != "" {
+			voiceSeconds, activitySeconds = 0, seconds
+		}
+		date := utils.FormatDate(span.Start, loc)
+		if err := b.repository.AddDailyStatsContext(ctx, date, userID, guildID, voiceSeconds, activitySeconds, activityName); err != nil {
+			log.Printf("Error adding daily stats: %v", err)
+		}
+		weekly[utils.FormatDate(utils.WeekStart(span.Start, loc), loc)] += seconds
+	}
+
+	for weekStart, seconds := range weekly {
+		voiceSeconds, activitySeconds := seconds, int64(0)
+		if activityName != "" {
+			voiceSeconds, activitySeconds = 0, seconds
+		}
+		if err := b.repository.AddWeeklyStatsContext(ctx, weekStart, userID, guildID, voiceSeconds, activitySeconds, activityName); err != nil {
+			log.Printf("Error adding weekly stats: %v", err)
+		}
+	}
+}
+
+// presenceUpdate handles presence updates for activity tracking
+func (b *Bot) presenceUpdate(s *discordgo.Session, p *discordgo.PresenceUpdate) {
+	b.trackPresence(b.ctx, s, p.GuildID, p.User.ID, p.Activities)
+}
+
+// trackPresence opens and closes activity sessions to match a user's
+// current activities
+func (b *Bot) trackPresence(ctx context.Context, s *discordgo.Session, guildID, userID string, activities []*discordgo.Activity) {
+	log.Printf("presenceUpdate: guild=%s user=%s activities=%d", guildID, userID, len(activities))
+
+	// The user's name is only looked up once there is an activity to log;
+	// the locked section below only logs activities collected here
+	var username string
+
+	// Collect relevant activity names, normalized and keyed
+	// case-insensitively, with their types and the names this guild's
+	// aliases give them. Sessions and global totals use the normalized
+	// name, so every guild agrees on it.
+	activeSet := make(map[string]string)
+	types := make(map[string]string)
+	guildNames := make(map[string]string)
+	tracks := make(map[string]models.TrackPlay)
+	details := make(map[string]string)
+	for _, act := range activities {
+		if act.Type == discordgo.ActivityTypeCustom && !b.trackCustomStatus {
+			continue
+		}
+		name := utils.NormalizeActivityName(act.Name)
+		if name != "" {
+			if username == "" {
+				username = b.username(s, guildID, userID)
+			}
+			activeSet[strings.ToLower(name)] = name
+			types[strings.ToLower(name)] = activityType(act.Type)
+			guildNames[strings.ToLower(name)] = b.resolveActivityName(ctx, guildID, name)
+			log.Printf("activity on: %s (%s) | %s (%s)", username, userID, name, activityType(act.Type))
+			if b.detailActivities(ctx, guildID)[utils.ActivityKey(guildNames[strings.ToLower(name)])] {
+				details[strings.ToLower(name)] = activityDetail(act)
+			}
+		}
+		// Spotify reports the track in Details, its artists in State and
+		// the album in the large image text
+		if act.Type == discordgo.ActivityTypeListening && act.Name == "Spotify" && act.Details != "" {
+			tracks[strings.ToLower(name)] = models.TrackPlay{
+				Title:  act.Details,
+				Artist: act.State,
+				Album:  act.Assets.LargeText,
+			}
+		}
+	}
+
+	now := time.Now().UTC()
+
+	b.trackingMu.Lock()
+
+	// Stop counting activities that are no longer reported in this guild;
+	// a session only ends once no guild reports it. Keep tracking the
+	// others under the name they were opened with. Ended sessions close
+	// once the grace period passes, so an activity that comes back before
+	// then continues its session.
+	// key format: user:activity (global)
+	prefix := userID + ":"
+	for _, key := range sessionKeys(b.activitySessions, prefix) {
+		session := b.activitySessions[key]
+		activityName := strings.TrimPrefix(key, prefix)
+		if _, active := activeSet[strings.ToLower(activityName)]; !active {
+			b.removeActivityGuild(ctx, userID, activityName, guildID, now)
+			continue
+		}
+		if !session.Ended.IsZero() {
+			session.Ended = time.Time{}
+			b.activitySessions[key] = session
+			b.saveOpenActivitySession(ctx, userID, activityName, session, now)
+			log.Printf("activity back: %s (%s) | %s", username, userID, activityName)
+		}
+		activeSet[strings.ToLower(activityName)] = activityName
+	}
+	b.closeEndedActivitySessions(ctx, userID, now)
+
+	// Start new activities that haven't been recorded, count running ones
+	// in this guild too from now on and follow Spotify track and rich
+	// presence detail changes. Details are only followed from guilds that
+	// track them, so other guilds don't end them.
+	for lower, name := range activeSet {
+		key := userID + ":" + name
+		session, tracked := b.activitySessions[key]
+		if !tracked {
+			b.openActivitySession(ctx, userID, guildID, name, guildNames[lower], types[lower], now)
+			log.Printf("activity start: %s (%s) | %s", username, userID, name)
+			session = b.activitySessions[key]
+		} else if _, reported := session.Guilds[guildID]; !reported {
+			// Time so far goes to the guilds already reporting it. A
+			// session back from a gap has none, so the gap goes to this
+			// guild with the rest of the session instead of only to the
+			// global totals.
+			if len(session.Guilds) > 0 {
+				b.creditActivity(ctx, userID, name, &session, now)
+			}
+			session.Guilds[guildID] = models.ActivityGuild{Name: guildNames[lower]}
+		}
+		b.playTrack(ctx, userID, &session, tracks[lower], now)
+		if detail, tracked := details[lower]; tracked {
+			b.playDetail(ctx, userID, name, &session, detail, now)
+		}
+		b.activitySessions[key] = session
+	}
+
+	b.trackingMu.Unlock()
+	b.runStoreQueue()
+}
+
+// playTrack records the previous track of a session when the track being
+// played changes. An empty track means nothing is playing.
+func (b *Bot) playTrack(ctx context.Context, userID string, session *models.ActivitySession, track models.TrackPlay, now time.Time) {
+	if track.Title == session.Track.Title && track.Artist == session.Track.Artist {
+		return
+	}
+	b.finishTrack(ctx, userID, session, now)
+	if track.Title != "" {
+		track.Start = now
+		session.Track = track
+	}
+}
+
+// finishTrack adds the track a session is playing to the listening history
+// and to the listening totals of the user and of every guild that reported
+// the session. Tracks ending before the session reaches the minimum
+// duration are dropped with it.
+func (b *Bot) finishTrack(ctx context.Context, userID string, session *models.ActivitySession, end time.Time) {
+	track := session.Track
+	session.Track = models.TrackPlay{}
+	if track.Start.IsZero() || !b.activityCounted(session, end) {
+		return
+	}
+
+	seconds := int64(end.Sub(track.Start) / time.Second)
+	if seconds <= 0 {
+		return
+	}
+
+	guildIDs := make([]string, 0, len(session.Guilds))
+	for guildID := range session.Guilds {
+		guildIDs = append(guildIDs, guildID)
+	}
+
+	b.queueStore(func() {
+		if err := b.repository.AddListeningSessionContext(ctx, database.ListeningSession{
+			UserID:    userID,
+			Track:     track.Title,
+			Artist:    track.Artist,
+			Album:     track.Album,
+			StartedAt: track.Start,
+			EndedAt:   end,
+		}); err != nil {
+			log.Printf("Error adding listening session: %v", err)
+		}
+		if err := b.repository.AddTrackSecondsContext(ctx, userID, track.Artist, track.Title, seconds); err != nil {
+			log.Printf("Error adding track seconds: %v", err)
+		}
+		for _, guildID := range guildIDs {
+			if err := b.repository.AddGuildTrackSecondsContext(ctx, userID, guildID, track.Artist, track.Title, seconds); err != nil {
+				log.Printf("Error adding guild track seconds: %v", err)
+			}
+		}
+	})
+}
+
+// activityDetail joins an activity's rich presence details and state, such
+// as "Competitive - Ascent"
+func activityDetail(act *discordgo.Activity) string {
+	var parts []string
+	for _, part := range []string{act.Details, act.State} {
+		if part = utils.NormalizeActivityName(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, " - ")
+}
+
+// playDetail credits the previous rich presence detail of a session when
+// it changes. An empty detail means none is shown.
+func (b *Bot) playDetail(ctx context.Context, userID, activityName string, session *models.ActivitySession, detail string, now time.Time) {
+	if detail == session.Detail {
+		return
+	}
+	b.creditDetail(ctx, userID, activityName, session, now)
+	session.Detail = detail
+	session.DetailCredited = now
+}
+
+// creditDetail adds the time spent in a session's rich presence detail
+// since it was last credited up to end and advances session.DetailCredited.
+// Time before the session reaches the minimum duration is dropped.
+func (b *Bot) creditDetail(ctx context.Context, userID, activityName string, session *models.ActivitySession, end time.Time) {
+	if session.Detail == "" {
+		return
+	}
+	seconds := int64(end.Truncate(time.Second).Sub(session.DetailCredited.Truncate(time.Second)) / time.Second)
+	session.DetailCredited = end
+	if seconds <= 0 || !b.activityCounted(session, end) {
+		return
+	}
+	detail := session.Detail
+	b.queueStore(func() {
+		if err := b.repository.AddActivityDetailSecondsContext(ctx, userID, activityName, detail, seconds); err != nil {
+			log.Printf("Error adding activity detail seconds: %v", err)
+		}
+	})
+}
+
+// activityType maps a presence activity type to the recorded type
+func activityType(t discordgo.ActivityType) string {
+	switch t {
+	case discordgo.ActivityTypeStreaming:
+		return database.ActivityTypeStreaming
+	case discordgo.ActivityTypeListening:
+		return database.ActivityTypeListening
+	case discordgo.ActivityTypeWatching:
+		return database.ActivityTypeWatching
+	case discordgo.ActivityTypeCompeting:
+		return database.ActivityTypeCompeting
+	case discordgo.ActivityTypeCustom:
+		return database.ActivityTypeCustom
+	default:
+		return database.ActivityTypePlaying
+	}
+}
+
+// openActivitySession starts tracking an activity of the given type for a
+// user, reported in the given guild under guildName. The caller must hold
+// trackingMu.
+func (b *Bot) openActivitySession(ctx context.Context, userID, guildID, activityName, guildName, activityType string, now time.Time) {
+	b.queueStore(func() {
+		if err := b.repository.SaveActivityTypeContext(ctx, activityName, activityType); err != nil {
+			log.Printf("Error saving activity type: %v", err)
+		}
+	})
+
+	start, credited := b.resume(ctx, database.SessionKindActivity, "", userID, activityName, now)
+	session := models.ActivitySession{
+		Start:    start,
+		Credited: credited,
+		GuildID:  guildID,
+		Guilds:   map[string]models.ActivityGuild{guildID: {Name: guildName}},
+	}
+	b.activitySessions[userID+":"+activityName] = session
+	b.saveOpenActivitySession(ctx, userID, activityName, session, now)
+}
+
+// closeActivitySession stops tracking an activity, credits the time since
+// the last checkpoint and returns the session's total duration. Ended
+// sessions are closed when the activity disappeared rather than at now.
+// The caller must hold trackingMu.
+func (b *Bot) closeActivitySession(ctx context.Context, userID, activityName string, now time.Time) int64 {
+	key := userID + ":" + activityName
+	session := b.activitySessions[key]
+	delete(b.activitySessions, key)
+	if !session.Ended.IsZero() {
+		now = session.Ended
+	}
+
+	b.creditActivity(ctx, userID, activityName, &session, now)
+	b.finishTrack(ctx, userID, &session, now)
+
+	b.queueStore(func() {
+		if err := b.repository.DeleteOpenSessionContext(ctx, database.SessionKindActivity, userID, session.GuildID, activityName); err != nil {
+			log.Printf("Error deleting open activity session: %v", err)
+		}
+	})
+	return int64(now.Sub(session.Start).Seconds())
+}
+
+// removeActivityGuild stops counting an activity session in a guild after
+// crediting it up to now, and ends the session once no guild reports it.
+// The caller must hold trackingMu.
+func (b *Bot) removeActivityGuild(ctx context.Context, userID, activityName, guildID string, now time.Time) {
+	key := userID + ":" + activityName
+	session := b.activitySessions[key]
+	if _, reported := session.Guilds[guildID]; !reported {
+		return
+	}
+	b.creditActivity(ctx, userID, activityName, &session, now)
+	delete(session.Guilds, guildID)
+	b.activitySessions[key] = session
+	if len(session.Guilds) > 0 {
+		return
+	}
+
+	if b.activityGrace <= 0 {
+		seconds := b.closeActivitySession(ctx, userID, activityName, now)
+		log.Printf("activity off: %s | %s +%ds", userID, activityName, seconds)
+		return
+	}
+	session.Ended = now
+	b.activitySessions[key] = session
+	b.saveOpenActivitySession(ctx, userID, activityName, session, now)
+	log.Printf("activity ended: %s | %s, closing in %s", userID, activityName, b.activityGrace)
+}
+
+// removeGuildActivities stops counting activity sessions in a guild for
+// every user not in keep. The caller must hold trackingMu.
+func (b *Bot) removeGuildActivities(ctx context.Context, guildID string, keep map[string]bool, now time.Time) {
+	for _, key := range sessionKeys(b.activitySessions, "") {
+		userID, activityName, _ := strings.Cut(key, ":")
+		if _, reported := b.activitySessions[key].Guilds[guildID]; !reported || keep[userID] {
+			continue
+		}
+		b.removeActivityGuild(ctx, userID, activityName, guildID, now)
+	}
+}
+
+// closeEndedActivitySessions closes the activity sessions of a user, or of
+// every user if userID is empty, that ended more than the grace period
+// before now. The caller must hold trackingMu.
+func (b *Bot) closeEndedActivitySessions(ctx context.Context, userID string, now time.Time) {
+	prefix := ""
+	if userID != "" {
+		prefix = userID + ":"
+	}
+	for _, key := range sessionKeys(b.activitySessions, prefix) {
+		if ended := b.activitySessions[key].Ended; ended.IsZero() || now.Sub(ended) < b.activityGrace {
+			continue
+		}
+		sessionUserID, activityName, _ := strings.Cut(key, ":")
+		seconds := b.closeActivitySession(ctx, sessionUserID, activityName, now)
+		log.Printf("activity off: %s | %s +%ds", sessionUserID, activityName, seconds)
+	}
+}
+
+// saveOpenActivitySession queues persisting an open activity session
+func (b *Bot) saveOpenActivitySession(ctx context.Context, userID, activityName string, session models.ActivitySession, now time.Time) {
+	open := database.OpenSession{
+		Kind:          database.SessionKindActivity,
+		UserID:        userID,
+		GuildID:       session.GuildID,
+		Subject:       activityName,
+		StartedAt:     session.Start,
+		CreditedUntil: session.Credited,
+		LastSeen:      now,
+		RunID:         b.runID,
+		Ended:         session.Ended,
+	}
+	b.queueStore(func() {
+		if err := b.repository.SaveOpenSessionContext(ctx, open); err != nil {
+			log.Printf("Error saving open activity session: %v", err)
+		}
+	})
+}
+
+// creditActivity adds an activity session's time since it was last credited
+// up to end to the user's totals, and to the session log, totals and period
+// stats of every guild that reported it, along with its rich presence
+// detail. Guild totals and stats use the guild's name for the activity.
+// The writes are queued with queueStore. It advances session.Credited and
+// returns the credited seconds, which are 0 while the session is shorter
+// than the minimum duration.
+func (b *Bot) creditActivity(ctx context.Context, userID, activityName string, session *models.ActivitySession, end time.Time) int64 {
+	// Nothing is credited until the session reaches the minimum duration,
+	// so shorter sessions are discarded when they close
+	if !b.activityCounted(session, end) {
+		return 0
+	}
+
+	start := session.Credited.Truncate(time.Second)
+	session.Credited = end
+	end = end.Truncate(time.Second)
+	seconds := int64(end.Sub(start) / time.Second)
+
+	if session.Guilds == nil {
+		session.Guilds = map[string]models.ActivityGuild{session.GuildID: {Name: activityName}}
+	}
+	for guildID, guild := range session.Guilds {
+		if guild.Log == nil {
+			guild.Log = &models.SessionLogRow{}
+			session.Guilds[guildID] = guild
+		}
+
+		b.queueStore(func() {
+			if guild.Log.ID != 0 {
+				if err := b.repository.ExtendSessionLogContext(ctx, guild.Log.ID, end); err != nil {
+					log.Printf("Error extending activity session log: %v", err)
+				}
+			} else if end.After(start) {
+				id, err := b.repository.AddSessionLogContext(ctx, database.SessionLog{
+					Kind:      database.SessionKindActivity,
+					UserID:    userID,
+					GuildID:   guildID,
+					Subject:   activityName,
+					StartedAt: start,
+					EndedAt:   end,
+				})
+				if err != nil {
+					log.Printf("Error adding activity session log: %v", err)
+				} else {
+					guild.Log.ID = id
+				}
+			}
+
+			if err := b.repository.AddGuildActivitySecondsContext(ctx, userID, guildID, guild.Name, seconds); err != nil {
+				log.Printf("Error adding guild activity seconds: %v", err)
+			}
+			b.creditPeriods(ctx, userID, guildID, guild.Name, start, end)
+		})
+	}
+
+	b.queueStore(func() {
+		if err := b.repository.AddActivitySecondsContext(ctx, userID, activityName, seconds); err != nil {
+			log.Printf("Error adding activity seconds: %v", err)
+		}
+	})
+	b.creditDetail(ctx, userID, activityName, session, end)
+	return seconds
+}
+
+// activityCounted reports whether an activity session has reached the
+// minimum duration by end, so time in it may be credited. Time in details
+// and tracks follows the session, so a short session's breakdown doesn't
+// outgrow its total.
+func (b *Bot) activityCounted(session *models.ActivitySession, end time.Time) bool {
+	return session.Credited.After(session.Start) || end.Sub(session.Start) >= b.activityMinDuration
+}
+
+// username resolves a user's name from the state cache, asking the API only
+// for members that aren't cached, and falls back to the user ID
+func (b *Bot) username(s *discordgo.Session, guildID, userID string) string {
+	if member, err := s.State.Member(guildID, userID); err == nil && member.User != nil && member.User.Username != "" {
+		return member.User.Username
+	}
+	user, err := s.User(userID)
+	if err == nil && user != nil {
+		return user.Username
+	}
+	return userID
+}
+
+// channelName resolves a channel's name from the state cache or the API,
+// falling back to the channel ID
+func (b *Bot) channelName(s *discordgo.Session, channelID string) string {
+	if channel, err := s.State.Channel(channelID); err == nil {
+		return channel.Name
+	}
+	channel, err := s.Channel(channelID)
+	if err == nil && channel != nil {
+		return channel.Name
+	}
+	return channelID
+}
@@ -0,0 +1,179 @@
+package discord
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+
+	"playstats/internal/config"
+	"playstats/internal/database"
+)
+
+// voiceState delivers a voice state update to the bot; an empty channelID
+// leaves voice
+func voiceState(bot *Bot, guildID, userID, channelID string, muted bool) {
+	bot.voiceStateUpdate(bot.session, &discordgo.VoiceStateUpdate{VoiceState: &discordgo.VoiceState{
+		GuildID:   guildID,
+		UserID:    userID,
+		ChannelID: channelID,
+		SelfMute:  muted,
+	}})
+}
+
+// presence delivers a presence update to the bot
+func presence(bot *Bot, guildID, userID string, activities ...string) {
+	update := &discordgo.PresenceUpdate{GuildID: guildID}
+	update.User = &discordgo.User{ID: userID}
+	for _, name := range activities {
+		update.Activities = append(update.Activities, &discordgo.Activity{Name: name, Type: discordgo.ActivityTypeGame})
+	}
+	bot.presenceUpdate(bot.session, update)
+}
+
+// Run with -race: voice, presence and checkpoint events arrive on their
+// own goroutines, as discordgo delivers them
+func TestConcurrentTracking(t *testing.T) {
+	bot, store, _ := newTestBot(t, &config.Config{ActivityGracePeriod: time.Minute})
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		userID := fmt.Sprintf("u%d", i)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 30; j++ {
+				voiceState(bot, "g1", userID, fmt.Sprintf("c%d", j%3), j%2 == 0)
+			}
+			voiceState(bot, "g1", userID, "", false)
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 30; j++ {
+				guildID := fmt.Sprintf("g%d", j%2+1)
+				if j%3 == 0 {
+					presence(bot, guildID, userID)
+				} else {
+					presence(bot, guildID, userID, "Valorant", fmt.Sprintf("Game %d", j%4))
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 10; j++ {
+			bot.checkpointSessions(ctx, time.Now().UTC())
+		}
+	}()
+	wg.Wait()
+
+	bot.closeAllSessions(ctx, time.Now().UTC())
+
+	bot.trackingMu.Lock()
+	remaining := len(bot.sessions) + len(bot.activitySessions) + len(bot.occupancy)
+	bot.trackingMu.Unlock()
+	if remaining != 0 {
+		t.Errorf("%d sessions or occupied channels left after closing all sessions", remaining)
+	}
+	// Saves and deletes of open sessions must land in the order they were
+	// made, or closed sessions would be left behind
+	if sessions, _ := store.GetOpenSessionsContext(ctx); len(sessions) != 0 {
+		t.Errorf("open sessions = %+v, want none", sessions)
+	}
+}
+
+// blockingStore holds SaveOpenSessionContext calls until release is closed
+type blockingStore struct {
+	*database.MemoryStore
+	saving  chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) SaveOpenSessionContext(ctx context.Context, session database.OpenSession) error {
+	select {
+	case s.saving <- struct{}{}:
+	default:
+	}
+	<-s.release
+	return s.MemoryStore.SaveOpenSessionContext(ctx, session)
+}
+
+func TestTrackingUnlockedDuringStoreWrites(t *testing.T) {
+	store := &blockingStore{
+		MemoryStore: database.NewMemoryStore(),
+		saving:      make(chan struct{}, 1),
+		release:     make(chan struct{}),
+	}
+	bot, _ := newTestBotWithStore(t, nil, store)
+
+	done := make(chan struct{})
+	go func() {
+		voiceState(bot, "g1", "u1", "c1", false)
+		close(done)
+	}()
+
+	<-store.saving
+	if !bot.trackingMu.TryLock() {
+		t.Error("trackingMu is held while the open session is saved")
+	} else {
+		bot.trackingMu.Unlock()
+	}
+	close(store.release)
+	<-done
+
+	if sessions, _ := store.GetOpenSessionsContext(context.Background()); len(sessions) != 1 {
+		t.Errorf("open sessions = %+v, want the voice session", sessions)
+	}
+}
+
+func TestGuildCreateSeedsWithoutUserLookups(t *testing.T) {
+	bot, _, fake := newTestBot(t, nil)
+	guild := &discordgo.Guild{
+		ID:      "g1",
+		Members: []*discordgo.Member{{GuildID: "g1", User: &discordgo.User{ID: "u3", Username: "three"}}},
+		Presences: []*discordgo.Presence{
+			{User: &discordgo.User{ID: "u1"}},
+			{User: &discordgo.User{ID: "u2"}},
+			{User: &discordgo.User{ID: "u3"}, Activities: []*discordgo.Activity{{Name: "Valorant", Type: discordgo.ActivityTypeGame}}},
+		},
+	}
+	bot.session.State.GuildAdd(guild)
+
+	bot.guildCreate(bot.session, &discordgo.GuildCreate{Guild: guild})
+
+	if lookups := fake.lookups(); lookups != 0 {
+		t.Errorf("made %d API lookups while seeding, want 0", lookups)
+	}
+	bot.trackingMu.Lock()
+	if _, tracked := bot.activitySessions["u3:Valorant"]; !tracked {
+		t.Error("the seeded activity is not tracked")
+	}
+	bot.trackingMu.Unlock()
+}
+
+func TestIgnoreSettlesChannelSessions(t *testing.T) {
+	bot, store, _ := newTestBot(t, nil)
+	ctx := context.Background()
+	bot.session.State.GuildAdd(&discordgo.Guild{ID: "g1", OwnerID: "admin"})
+	bot.session.State.ChannelAdd(&discordgo.Channel{ID: "text", GuildID: "g1"})
+	start := time.Now().UTC().Add(-time.Hour)
+
+	bot.trackingMu.Lock()
+	bot.openVoiceSession(ctx, "g1:u1", "u1", "g1", "c1", voiceFlags(&discordgo.VoiceState{}), true, start)
+	bot.trackingMu.Unlock()
+	bot.runStoreQueue()
+
+	send(bot, "admin", "!ignore <#c1>")
+
+	if total, _ := store.GetVoiceHoursContext(ctx, "u1", "g1"); total < 3599 {
+		t.Errorf("voice hours = %d, want the hour before the channel was ignored", total)
+	}
+	if idle, _ := store.GetIdleHoursContext(ctx, "u1", "g1"); idle > 1 {
+		t.Errorf("idle hours = %d, want none", idle)
+	}
+}
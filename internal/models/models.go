@@ -2,10 +2,72 @@ package models
 
 import "time"
 
-// VoiceSession represents a user's voice channel session
+// VoiceSession represents a user's voice channel session. Credited is the
+// time up to which the session has been written to the totals, and Solo is
+// set while the channel has fewer humans than the guild requires. Log is
+// the session log row being extended, or nil to start a new one.
 type VoiceSession struct {
 	Start     time.Time
+	Credited  time.Time
 	ChannelID string
+	Flags     VoiceFlags
+	Solo      bool
+	Log       *SessionLogRow
+}
+
+// SessionLogRow refers to the session log row a session is extending.
+// Sessions are credited before their rows are written, so ID is 0 until
+// the row exists. Idle is whether the row was logged as idle time.
+type SessionLogRow struct {
+	ID   int64
+	Idle bool
+}
+
+// VoiceFlags represents the mute, deafen, go-live and camera state of a
+// voice session. Deafened takes precedence over Muted.
+type VoiceFlags struct {
+	Muted     bool
+	Deafened  bool
+	Streaming bool
+	Video     bool
+}
+
+// ActivitySession represents a user's activity session. GuildID is the
+// guild whose presence update started it and Credited is the time up to
+// which the session has been written to the totals. Guilds holds every
+// guild currently reporting the activity; the session ends once it is
+// empty. Track is the Spotify track being played, if any. Detail is the
+// rich presence detail, such as a game mode or map, credited since
+// DetailCredited when the game's details are tracked. Ended is when the
+// activity stopped being reported, or zero while it is; the session closes
+// there unless the activity returns within the grace period.
+type ActivitySession struct {
+	Start          time.Time
+	Credited       time.Time
+	Ended          time.Time
+	GuildID        string
+	Guilds         map[string]ActivityGuild
+	Track          TrackPlay
+	Detail         string
+	DetailCredited time.Time
+}
+
+// ActivityGuild represents a guild reporting an activity session. Name is
+// the activity's name under the guild's aliases, used for the guild's
+// totals and stats, and Log the guild's session log row, or nil if none
+// was started yet.
+type ActivityGuild struct {
+	Name string
+	Log  *SessionLogRow
+}
+
+// TrackPlay represents a track played on Spotify since Start. Start is
+// zero when no track is playing.
+type TrackPlay struct {
+	Title  string
+	Artist string
+	Album  string
+	Start  time.Time
 }
 
 // VoiceHours represents voice hours data in database
@@ -0,0 +1,19 @@
+package utils
+
+import "strings"
+
+// activitySymbols are dropped from activity names, since some games only add
+// them in some of their presences
+var activitySymbols = strings.NewReplacer("™", "", "®", "", "©", "")
+
+// NormalizeActivityName cleans up an activity name reported in a presence:
+// trademark symbols are dropped and whitespace is trimmed and collapsed
+func NormalizeActivityName(name string) string {
+	return strings.Join(strings.Fields(activitySymbols.Replace(name)), " ")
+}
+
+// ActivityKey returns the case-insensitive form of an activity name, used
+// to match names and aliases
+func ActivityKey(name string) string {
+	return strings.ToLower(NormalizeActivityName(name))
+}
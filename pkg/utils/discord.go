@@ -47,6 +47,17 @@ func FormatChannelMention(channelID string) string {
 	return fmt.Sprintf("<#%s>", channelID)
 }
 
+// ExtractChannelIDFromMention extracts channel ID from Discord channel mention
+func ExtractChannelIDFromMention(mention string) string {
+	channelID := strings.TrimPrefix(mention, "<#")
+	return strings.TrimSuffix(channelID, ">")
+}
+
+// IsChannelMention checks if a string is a valid channel mention
+func IsChannelMention(text string) bool {
+	return strings.HasPrefix(text, "<#") && strings.HasSuffix(text, ">")
+}
+
 // TruncateString truncates a string to max length and adds ellipsis if needed
 func TruncateString(s string, maxLen int) string {
 	if len(s) <= maxLen {
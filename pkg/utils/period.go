@@ -0,0 +1,46 @@
+package utils
+
+import "time"
+
+// Span represents a time range [Start, End)
+type Span struct {
+	Start time.Time
+	End   time.Time
+}
+
+// Seconds returns the whole seconds covered by the span
+func (s Span) Seconds() int64 {
+	return int64(s.End.Sub(s.Start) / time.Second)
+}
+
+// DayStart returns midnight at the start of t's day in loc
+func DayStart(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
+// WeekStart returns midnight on the Monday of t's week in loc
+func WeekStart(t time.Time, loc *time.Location) time.Time {
+	day := DayStart(t, loc)
+	offset := (int(day.Weekday()) + 6) % 7 // days since Monday
+	return day.AddDate(0, 0, -offset)
+}
+
+// FormatDate formats t as a YYYY-MM-DD date in loc
+func FormatDate(t time.Time, loc *time.Location) string {
+	return t.In(loc).Format("2006-01-02")
+}
+
+// SplitByDay splits [start, end) into spans that do not cross midnight in loc
+func SplitByDay(start, end time.Time, loc *time.Location) []Span {
+	var spans []Span
+	for start.Before(end) {
+		next := DayStart(start, loc).AddDate(0, 0, 1)
+		if next.After(end) {
+			next = end
+		}
+		spans = append(spans, Span{Start: start, End: next})
+		start = next
+	}
+	return spans
+}